@@ -1,21 +1,36 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 var (
 	// ErrAuthTokenInvalid indicates the the registry issued a token but revoked it.
 	ErrAuthTokenInvalid = fmt.Errorf("A token was issued but is not longer valid")
 	// ErrAuthTokenNoBearer indicates that a registry did not return the expected authenticaton header.
-	ErrAuthTokenNoBearer = fmt.Errorf("Www-authenticate header value does not start with 'Bearer'")
+	ErrAuthTokenNoBearer = fmt.Errorf("Www-authenticate header value does not contain a 'Bearer' challenge")
 )
 
+// Credentials authenticate a user against a registry or its token service.
+type Credentials struct {
+	// IdentityToken is a refresh token that is exchanged for an access token using the OAuth2 flow.
+	IdentityToken string
+	Password      string
+	Username      string
+}
+
 // A Authenticator is responsible for authenticating against the registry.
 type Authenticator interface {
 	// HandleRequest is called each time before a request is sent to the registry.
@@ -24,6 +39,175 @@ type Authenticator interface {
 	HandleResponse(resp *http.Response) (*http.Response, bool, error)
 }
 
+// AuthenticatorOptions configure the requests that an Authenticator sends itself, e.g. to ping a registry or to request a token.
+type AuthenticatorOptions struct {
+	// Client sends the requests. Defaults to a http.Client without a timeout.
+	Client *http.Client
+	// Retry configures how failed requests are retried. Retries are disabled by default.
+	// Requests to a token service are retried even though they use the method POST.
+	Retry RetryPolicy
+}
+
+// client returns the http.Client that sends the requests of an Authenticator.
+func (o AuthenticatorOptions) client() *http.Client {
+	if o.Client == nil {
+		return &http.Client{}
+	}
+
+	return o.Client
+}
+
+// schemeAuthenticator is an Authenticator for one authentication scheme.
+type schemeAuthenticator struct {
+	auth   Authenticator
+	scheme string
+}
+
+type autoAuthenticator struct {
+	credentials Credentials
+	// hosts stores the Authenticator detected for each host.
+	hosts   map[string]schemeAuthenticator
+	mutex   sync.Mutex
+	options AuthenticatorOptions
+	// pingMutex ensures that concurrent first requests to a host ping it only once.
+	pingMutex sync.Mutex
+}
+
+func (a *autoAuthenticator) HandleRequest(r *http.Request) error {
+	sa, ok := a.lookup(r.URL.Host)
+	if !ok {
+		var err error
+		sa, err = a.detectByPing(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sa.auth.HandleRequest(r)
+}
+
+func (a *autoAuthenticator) HandleResponse(resp *http.Response) (*http.Response, bool, error) {
+	if resp.Request == nil {
+		return resp, false, nil
+	}
+
+	sa, ok := a.lookup(resp.Request.URL.Host)
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The registry can require a different scheme than the one it announced when pinging it.
+		challenges := challengesFromResponse(resp)
+		if next := a.selectScheme(challenges); ok && next != sa.scheme {
+			sa = a.detect(resp.Request.URL.Host, challenges)
+			if sa.scheme != "" {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				return resp, true, nil
+			}
+		}
+	}
+
+	if !ok {
+		return resp, false, nil
+	}
+
+	return sa.auth.HandleResponse(resp)
+}
+
+// lookup returns the Authenticator detected for host.
+func (a *autoAuthenticator) lookup(host string) (schemeAuthenticator, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	sa, ok := a.hosts[host]
+	return sa, ok
+}
+
+// detectByPing pings the host of r and selects an Authenticator based on the challenges it sends.
+// Concurrent callers wait for the first ping instead of pinging the host again.
+func (a *autoAuthenticator) detectByPing(r *http.Request) (schemeAuthenticator, error) {
+	a.pingMutex.Lock()
+	defer a.pingMutex.Unlock()
+	if sa, ok := a.lookup(r.URL.Host); ok {
+		return sa, nil
+	}
+
+	challenges, err := a.ping(r)
+	if err != nil {
+		return schemeAuthenticator{}, err
+	}
+
+	return a.detect(r.URL.Host, challenges), nil
+}
+
+// detect selects an Authenticator based on the challenges sent by a registry and stores it for the host.
+func (a *autoAuthenticator) detect(host string, challenges []challenge) schemeAuthenticator {
+	sa := schemeAuthenticator{scheme: a.selectScheme(challenges)}
+	switch sa.scheme {
+	case "bearer":
+		sa.auth = NewTokenAuthenticatorWithOptions(a.credentials, a.options)
+	case "basic":
+		sa.auth = NewBasicAuthenticator(a.credentials.Username, a.credentials.Password)
+	default:
+		sa.auth = NewNullAuthenticator()
+	}
+
+	a.mutex.Lock()
+	a.hosts[host] = sa
+	a.mutex.Unlock()
+	return sa
+}
+
+// ping queries the base endpoint of the registry and returns the challenges it sends.
+func (a *autoAuthenticator) ping(r *http.Request) ([]challenge, error) {
+	u := fmt.Sprintf("%s://%s/v2/", r.URL.Scheme, r.URL.Host)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.options.Retry.do(req.WithContext(r.Context()), a.options.client().Do)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pinging '%s'", u)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, nil
+	}
+
+	return challengesFromResponse(resp), nil
+}
+
+// selectScheme returns the scheme to use for a set of challenges.
+// Bearer is preferred over Basic. Basic is only selected if credentials are available.
+func (a *autoAuthenticator) selectScheme(challenges []challenge) string {
+	if _, ok := findChallenge(challenges, "bearer"); ok {
+		return "bearer"
+	}
+
+	if _, ok := findChallenge(challenges, "basic"); ok && a.credentials.Username != "" {
+		return "basic"
+	}
+
+	return ""
+}
+
+// NewAuthenticator returns an Authenticator that detects the authentication scheme of a registry.
+// It pings the registry before the first request and uses basic or token authentication depending on the challenge returned by the registry.
+// The credentials are used for either scheme.
+func NewAuthenticator(c Credentials) Authenticator {
+	return NewAuthenticatorWithOptions(c, AuthenticatorOptions{})
+}
+
+// NewAuthenticatorWithOptions returns an Authenticator that detects the authentication scheme of a registry, see NewAuthenticator().
+// The options also apply to the Authenticator of the detected scheme.
+func NewAuthenticatorWithOptions(c Credentials, o AuthenticatorOptions) Authenticator {
+	return &autoAuthenticator{
+		credentials: c,
+		hosts:       map[string]schemeAuthenticator{},
+		options:     o,
+	}
+}
+
 type basicAuthenticator struct {
 	password string
 	username string
@@ -46,6 +230,62 @@ func NewBasicAuthenticator(username, password string) Authenticator {
 	return &basicAuthenticator{password: password, username: username}
 }
 
+type keychainAuthenticator struct {
+	auth     Authenticator
+	domain   string
+	keychain Keychain
+	mutex    sync.Mutex
+	options  AuthenticatorOptions
+}
+
+func (k *keychainAuthenticator) HandleRequest(r *http.Request) error {
+	auth, err := k.authenticator()
+	if err != nil {
+		return err
+	}
+
+	return auth.HandleRequest(r)
+}
+
+func (k *keychainAuthenticator) HandleResponse(resp *http.Response) (*http.Response, bool, error) {
+	auth, err := k.authenticator()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return auth.HandleResponse(resp)
+}
+
+// authenticator looks up the credentials and creates the Authenticator that uses them.
+// Only a successful lookup is cached, so that a failed lookup, e.g. of a credential helper that timed out, is repeated with the next request.
+func (k *keychainAuthenticator) authenticator() (Authenticator, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.auth != nil {
+		return k.auth, nil
+	}
+
+	c, err := k.keychain.Credentials(k.domain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up credentials of '%s'", k.domain)
+	}
+
+	k.auth = NewAuthenticatorWithOptions(c, k.options)
+	return k.auth, nil
+}
+
+// NewKeychainAuthenticator returns an Authenticator that looks up the credentials of the registry at domain in a Keychain.
+// The credentials are looked up when the first request is sent. A failed lookup is repeated with the next request.
+func NewKeychainAuthenticator(k Keychain, domain string) Authenticator {
+	return NewKeychainAuthenticatorWithOptions(k, domain, AuthenticatorOptions{})
+}
+
+// NewKeychainAuthenticatorWithOptions returns an Authenticator that looks up the credentials of the registry at domain in a Keychain, see NewKeychainAuthenticator().
+// The options apply to the Authenticator that uses the credentials.
+func NewKeychainAuthenticatorWithOptions(k Keychain, domain string, o AuthenticatorOptions) Authenticator {
+	return &keychainAuthenticator{domain: domain, keychain: k, options: o}
+}
+
 type nullAuthenticator struct{}
 
 func (n *nullAuthenticator) HandleRequest(r *http.Request) error { return nil }
@@ -55,37 +295,100 @@ func (n *nullAuthenticator) HandleResponse(r *http.Response) (*http.Response, bo
 }
 
 // NewNullAuthenticator returns an Authenticator that does not modify the request or the response.
-// It is used as a fallback if not Authenticator is set.
 func NewNullAuthenticator() Authenticator {
 	return &nullAuthenticator{}
 }
 
+// oauthClientID identifies this library to token services that implement the OAuth2 flow.
+const oauthClientID = "registry-client"
+
 type tokenResponse struct {
-	ExpiresIn int64 `json:"expires_in"`
-	Token     string
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Token        string `json:"token"`
 }
 
-type tokenAuthenticator struct {
-	client    *http.Client
+// tokenKey identifies a token issued by a token service.
+type tokenKey struct {
+	realm string
+	// scope contains all scopes of the token, separated by a space.
+	scope   string
+	service string
+}
+
+// scopes returns all scopes of the token.
+func (k tokenKey) scopes() []string {
+	return strings.Fields(k.scope)
+}
+
+// withMountScope adds the scope to pull from the source repository if r mounts a blob from another repository.
+// Registries only challenge for the scope of the destination repository.
+func (k tokenKey) withMountScope(r *http.Request) tokenKey {
+	if r == nil {
+		return k
+	}
+
+	from := r.URL.Query().Get("from")
+	if from == "" || r.URL.Query().Get("mount") == "" {
+		return k
+	}
+
+	scope := fmt.Sprintf("repository:%s:pull", from)
+	for _, s := range k.scopes() {
+		if s == scope {
+			return k
+		}
+	}
+
+	k.scope = strings.TrimSpace(k.scope + " " + scope)
+	return k
+}
+
+type token struct {
 	expiresAt time.Time
-	realm     string
-	scope     string
-	service   string
-	token     string
+	value     string
+}
+
+var repositoryPathRegexp = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/`)
+
+type tokenAuthenticator struct {
+	client      *http.Client
+	credentials Credentials
+	// keys stores the token key that the registry challenged for a request. See requestKey().
+	// Keys are removed once their token expires.
+	keys  map[string]tokenKey
+	mutex sync.Mutex
+	retry RetryPolicy
+	// services stores the realm and the service of the token service of each host.
+	services map[string]tokenKey
+	tokens   map[tokenKey]token
 }
 
 func (t *tokenAuthenticator) HandleRequest(r *http.Request) error {
-	if t.token != "" {
-		if t.expiresAt.Before(time.Now()) {
-			err := t.requestToken()
-			if err != nil {
-				return err
-			}
+	t.mutex.Lock()
+	key, ok := t.keys[requestKey(r)]
+	if !ok {
+		key, ok = t.pushKey(r)
+	}
+
+	tok := t.tokens[key]
+	t.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if tok.expiresAt.Before(time.Now()) {
+		var err error
+		tok, err = t.requestToken(r.Context(), key)
+		if err != nil {
+			return err
 		}
 
-		r.Header.Set("Authorization", "Bearer "+t.token)
+		t.storeToken(r, key, tok)
 	}
 
+	r.Header.Set("Authorization", "Bearer "+tok.value)
 	return nil
 }
 
@@ -94,85 +397,269 @@ func (t *tokenAuthenticator) HandleResponse(resp *http.Response) (*http.Response
 		return resp, false, nil
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized && t.token != "" && t.expiresAt.After(time.Now()) {
+	key, parseErr := parseBearerChallenge(challengesFromResponse(resp))
+	if parseErr != nil {
+		return nil, false, parseErr
+	}
+
+	key = key.withMountScope(resp.Request)
+
+	t.mutex.Lock()
+	tok, ok := t.tokens[key]
+	t.mutex.Unlock()
+	if ok && tok.expiresAt.After(time.Now()) && resp.Request != nil && resp.Request.Header.Get("Authorization") == "Bearer "+tok.value {
 		return resp, false, ErrAuthTokenInvalid
 	}
 
-	wwwAuth := resp.Header.Get("www-authenticate")
-	var parseErr error
-	t.realm, t.scope, t.service, parseErr = parseAuthHeader(wwwAuth)
-	if parseErr != nil {
-		return nil, false, parseErr
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
 	}
 
-	err := t.requestToken()
+	tok, err := t.requestToken(ctx, key)
 	if err != nil {
 		return nil, false, err
 	}
 
+	t.storeToken(resp.Request, key, tok)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
 	return resp, true, nil
 }
 
-func (t *tokenAuthenticator) requestToken() error {
-	r, err := http.NewRequest("GET", t.realm, nil)
+// pushKey returns the key of a token that allows to push to the repository of r.
+// The token is requested before r is sent because the body of an upload cannot always be sent again after the registry challenged for a token.
+// The mutex needs to be held by the caller.
+func (t *tokenAuthenticator) pushKey(r *http.Request) (tokenKey, bool) {
+	if requestAccess(r.Method) != "push" {
+		return tokenKey{}, false
+	}
+
+	m := repositoryPathRegexp.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return tokenKey{}, false
+	}
+
+	key, ok := t.services[r.URL.Host]
+	if !ok {
+		return tokenKey{}, false
+	}
+
+	key.scope = fmt.Sprintf("repository:%s:pull,push", m[1])
+	return key.withMountScope(r), true
+}
+
+func (t *tokenAuthenticator) requestToken(ctx context.Context, key tokenKey) (token, error) {
+	t.mutex.Lock()
+	c := t.credentials
+	t.mutex.Unlock()
+	if c.IdentityToken == "" && (c.Username == "" || c.Password == "") {
+		return t.requestTokenGet(ctx, key, c)
+	}
+
+	tok, statusCode, err := t.requestTokenPost(ctx, key, c)
+	if err == nil {
+		return tok, nil
+	}
+
+	// Not every token service implements the OAuth2 flow. Fall back to a GET request like the Docker client does.
+	fallback := statusCode == http.StatusNotFound || statusCode == http.StatusMethodNotAllowed || statusCode == http.StatusUnauthorized
+	if !fallback || c.Username == "" {
+		return tok, err
+	}
+
+	return t.requestTokenGet(ctx, key, c)
+}
+
+// requestTokenGet requests a token as described in https://docs.docker.com/registry/spec/auth/token/.
+func (t *tokenAuthenticator) requestTokenGet(ctx context.Context, key tokenKey, c Credentials) (token, error) {
+	r, err := http.NewRequest("GET", key.realm, nil)
 	if err != nil {
-		return err
+		return token{}, err
 	}
 
 	q := r.URL.Query()
-	q.Set("scope", t.scope)
-	q.Set("service", t.service)
+	q["scope"] = key.scopes()
+	q.Set("service", key.service)
+	if c.Username != "" {
+		q.Set("account", c.Username)
+		r.SetBasicAuth(c.Username, c.Password)
+	}
+
 	r.URL.RawQuery = q.Encode()
-	resp, err := t.client.Do(r)
+	tok, _, err := t.doTokenRequest(r.WithContext(ctx))
+	return tok, err
+}
+
+// requestTokenPost requests a token as described in https://docs.docker.com/registry/spec/auth/oauth/.
+func (t *tokenAuthenticator) requestTokenPost(ctx context.Context, key tokenKey, c Credentials) (token, int, error) {
+	form := url.Values{}
+	form.Set("client_id", oauthClientID)
+	form.Set("scope", key.scope)
+	form.Set("service", key.service)
+	if c.IdentityToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", c.IdentityToken)
+	} else {
+		form.Set("grant_type", "password")
+		form.Set("password", c.Password)
+		form.Set("username", c.Username)
+	}
+
+	r, err := http.NewRequest("POST", key.realm, strings.NewReader(form.Encode()))
 	if err != nil {
-		return err
+		return token{}, 0, err
+	}
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return t.doTokenRequest(r.WithContext(ctx))
+}
+
+func (t *tokenAuthenticator) doTokenRequest(r *http.Request) (token, int, error) {
+	var tok token
+	// The POST request of the OAuth2 flow only exchanges credentials for a token, so it can be retried like a GET request.
+	resp, err := t.retry.doIdempotent(r, t.client.Do)
+	if err != nil {
+		return tok, 0, err
 	}
 
 	defer resp.Body.Close()
+	err = checkResponse(resp, http.StatusOK)
+	if err != nil {
+		return tok, resp.StatusCode, errors.Wrap(err, "requesting token")
+	}
+
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return tok, resp.StatusCode, err
 	}
 
 	tr := tokenResponse{}
 	err = json.Unmarshal(data, &tr)
 	if err != nil {
-		return err
+		return tok, resp.StatusCode, err
+	}
+
+	// The token spec defines a default of 60 seconds if the token service omits the expiration.
+	if tr.ExpiresIn == 0 {
+		tr.ExpiresIn = 60
+	}
+
+	tok.value = tr.Token
+	if tok.value == "" {
+		tok.value = tr.AccessToken
 	}
 
-	t.token = tr.Token
 	expiresInSeconds := time.Duration(tr.ExpiresIn-30) * time.Second
-	t.expiresAt = time.Now().Add(expiresInSeconds)
-	return nil
+	tok.expiresAt = time.Now().Add(expiresInSeconds)
+	if tr.RefreshToken != "" {
+		t.mutex.Lock()
+		t.credentials.IdentityToken = tr.RefreshToken
+		t.mutex.Unlock()
+	}
+
+	return tok, resp.StatusCode, nil
+}
+
+func (t *tokenAuthenticator) storeToken(r *http.Request, key tokenKey, tok token) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.removeExpired(time.Now())
+	t.tokens[key] = tok
+	if r != nil {
+		t.keys[requestKey(r)] = key
+		t.services[r.URL.Host] = tokenKey{realm: key.realm, service: key.service}
+	}
+}
+
+// removeExpired removes expired tokens and the keys of the requests that they authorized, so that the maps do not grow without bound.
+// A request whose key was removed is challenged by the registry again.
+// The mutex needs to be held by the caller.
+func (t *tokenAuthenticator) removeExpired(now time.Time) {
+	for key, tok := range t.tokens {
+		if tok.expiresAt.Before(now) {
+			delete(t.tokens, key)
+		}
+	}
+
+	for rk, key := range t.keys {
+		if _, ok := t.tokens[key]; !ok {
+			delete(t.keys, rk)
+		}
+	}
 }
 
 // NewTokenAuthenticator returns an Authenticator that handles authentication as described in https://docs.docker.com/registry/spec/auth/.
+// Tokens are requested anonymously.
 func NewTokenAuthenticator() Authenticator {
+	return NewTokenAuthenticatorWithCredentials(Credentials{})
+}
+
+// NewTokenAuthenticatorWithCredentials returns an Authenticator that handles authentication as described in https://docs.docker.com/registry/spec/auth/.
+// It presents the credentials to the token service.
+// If an identity token or a username and password are set, it uses the OAuth2 flow and falls back to a GET request if the token service does not support it.
+func NewTokenAuthenticatorWithCredentials(c Credentials) Authenticator {
+	return NewTokenAuthenticatorWithOptions(c, AuthenticatorOptions{})
+}
+
+// NewTokenAuthenticatorWithOptions returns an Authenticator that handles authentication as described in https://docs.docker.com/registry/spec/auth/.
+// It presents the credentials to the token service like NewTokenAuthenticatorWithCredentials() and sends its requests according to the options.
+func NewTokenAuthenticatorWithOptions(c Credentials, o AuthenticatorOptions) Authenticator {
 	return &tokenAuthenticator{
-		client: &http.Client{},
+		client:      o.client(),
+		credentials: c,
+		keys:        map[string]tokenKey{},
+		retry:       o.Retry,
+		services:    map[string]tokenKey{},
+		tokens:      map[tokenKey]token{},
 	}
 }
 
-func parseAuthHeader(h string) (string, string, string, error) {
-	if !strings.HasPrefix(h, "Bearer ") {
-		return "", "", "", ErrAuthTokenNoBearer
+// requestKey identifies all requests that are authorized by the same token.
+// These are requests with the same access, see requestAccess(), to the same repository in the same registry.
+// Requests that mount a blob also need to read from the same source repository.
+func requestKey(r *http.Request) string {
+	resource := r.URL.Path
+	if m := repositoryPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		resource = m[1]
 	}
 
-	var realm string
-	var scope string
-	var service string
-	parts := strings.Split(strings.TrimPrefix(h, "Bearer "), ",")
-	for _, p := range parts {
-		kv := strings.Split(p, "=")
-		switch kv[0] {
-		case "realm":
-			realm = strings.Trim(kv[1], `"`)
-		case "scope":
-			scope = strings.Trim(kv[1], `"`)
-		case "service":
-			service = strings.Trim(kv[1], `"`)
-		}
+	if from := r.URL.Query().Get("from"); from != "" && r.URL.Query().Get("mount") != "" {
+		resource += " from " + from
+	}
+
+	return requestAccess(r.Method) + " " + r.URL.Host + " " + resource
+}
+
+// requestAccess returns the access to a repository that a request with method needs.
+// All requests of an upload, e.g. POST, PATCH and PUT, need the same access.
+func requestAccess(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return "pull"
+	case "DELETE":
+		return "delete"
+	default:
+		return "push"
+	}
+}
+
+// parseBearerChallenge returns the key of the token that the registry requests in a Bearer challenge.
+// A challenge can contain multiple scopes, either in one "scope" parameter separated by spaces or in multiple "scope" parameters.
+func parseBearerChallenge(challenges []challenge) (tokenKey, error) {
+	c, ok := findChallenge(challenges, "bearer")
+	if !ok {
+		return tokenKey{}, ErrAuthTokenNoBearer
+	}
+
+	var scopes []string
+	for _, s := range c.parameters["scope"] {
+		scopes = append(scopes, strings.Fields(s)...)
 	}
 
-	return realm, scope, service, nil
+	return tokenKey{
+		realm:   c.parameter("realm"),
+		scope:   strings.Join(scopes, " "),
+		service: c.parameter("service"),
+	}, nil
 }
@@ -1,7 +1,15 @@
 package registry
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,27 +18,372 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestParseAuthHeader(t *testing.T) {
+// newTokenTestRegistry returns a registry that uses token authentication.
+// Reading from a repository requires the scope "repository:<name>:pull" and writing requires "repository:<name>:pull,push".
+// The token service issues tokens for any scope. The value of a token contains its scopes.
+func newTokenTestRegistry(t *testing.T, h http.Handler) (*Registry, func()) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"token":"%s","expires_in":300}`, strings.Join(r.URL.Query()["scope"], " "))
+	}))
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := repositoryPathRegexp.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		scope := fmt.Sprintf("repository:%s:pull", m[1])
+		if requestAccess(r.Method) != "pull" {
+			scope += ",push"
+		}
+
+		for _, s := range strings.Fields(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			if s == scope {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="registry",scope="%s"`, tokenSrv.URL, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	reg.Requester.Auth = NewTokenAuthenticator()
+	return reg, func() {
+		closeFunc()
+		tokenSrv.Close()
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
 	h := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/python:pull"`
-	realm, scope, service, err := parseAuthHeader(h)
+	key, err := parseBearerChallenge(parseChallenges(h))
+	require.NoError(t, err)
+	assert.Equal(t, "https://auth.docker.io/token", key.realm)
+	assert.Equal(t, "repository:library/python:pull", key.scope)
+	assert.Equal(t, "registry.docker.io", key.service)
+}
+
+func TestParseBearerChallenge_MultipleScopes(t *testing.T) {
+	h := `Basic realm="basic", Bearer realm="https://auth.example.com/token?a=b",service="registry",scope="repository:a:pull,push repository:b:pull",scope="registry:catalog:*"`
+	key, err := parseBearerChallenge(parseChallenges(h))
 	require.NoError(t, err)
-	assert.Equal(t, "https://auth.docker.io/token", realm)
-	assert.Equal(t, "repository:library/python:pull", scope)
-	assert.Equal(t, "registry.docker.io", service)
+	assert.Equal(t, "https://auth.example.com/token?a=b", key.realm)
+	assert.Equal(t, []string{"repository:a:pull,push", "repository:b:pull", "registry:catalog:*"}, key.scopes())
+	assert.Equal(t, "registry", key.service)
+}
+
+func TestParseBearerChallenge_NoBearer(t *testing.T) {
+	_, err := parseBearerChallenge(parseChallenges(`Basic realm="basic"`))
+	assert.Equal(t, ErrAuthTokenNoBearer, err)
 }
 
 func TestTokenAuthenticator_HandleResponse_ErrorIfAuthFails(t *testing.T) {
-	ta := &tokenAuthenticator{
+	key := tokenKey{realm: "https://auth.docker.io/token", scope: "repository:library/python:pull", service: "registry.docker.io"}
+	ta := NewTokenAuthenticator().(*tokenAuthenticator)
+	ta.tokens[key] = token{
 		expiresAt: time.Now().Add(30 * time.Second),
-		token:     "abc123",
+		value:     "abc123",
 	}
 
+	req, err := http.NewRequest("GET", "https://index.docker.io/v2/library/python/manifests/latest", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer abc123")
 	resp := &http.Response{
+		Header:     http.Header{},
+		Request:    req,
 		StatusCode: http.StatusUnauthorized,
 	}
+	resp.Header.Set("Www-Authenticate", `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/python:pull"`)
 
 	_, resend, err := ta.HandleResponse(resp)
 	assert.False(t, resend)
 	assert.Error(t, err)
 	assert.Equal(t, ErrAuthTokenInvalid, err)
 }
+
+func TestTokenAuthenticator_CachesTokenPerScope(t *testing.T) {
+	var tokenRequests int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		fmt.Fprintf(w, `{"token":"%s","expires_in":300}`, r.URL.Query().Get("scope"))
+	}))
+	defer tokenSrv.Close()
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")[0]
+		scope := fmt.Sprintf("repository:%s:pull", name)
+		if r.Header.Get("Authorization") != "Bearer "+scope {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="registry",scope="%s"`, tokenSrv.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `{"tags":["latest"]}`)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Auth = NewTokenAuthenticator()
+	for _, name := range []string{"a", "b", "a", "b"} {
+		tags, err := reg.Repository(name).Tags().GetAll()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"latest"}, tags)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := reg.Repository(name).Tags().GetAll()
+			assert.NoError(t, err)
+		}([]string{"a", "b"}[i%2])
+	}
+
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tokenRequests))
+}
+
+func TestTokenAuthenticator_RequestToken_Credentials(t *testing.T) {
+	key := tokenKey{scope: "repository:private:pull", service: "registry"}
+	testCases := []struct {
+		name        string
+		credentials Credentials
+		handler     http.HandlerFunc
+	}{
+		{
+			name:        "oauth2 password",
+			credentials: Credentials{Username: "user", Password: "secret"},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "POST", r.Method)
+				require.NoError(t, r.ParseForm())
+				assert.Equal(t, "password", r.PostForm.Get("grant_type"))
+				assert.Equal(t, "user", r.PostForm.Get("username"))
+				assert.Equal(t, "secret", r.PostForm.Get("password"))
+				assert.Equal(t, "repository:private:pull", r.PostForm.Get("scope"))
+				assert.Equal(t, "registry", r.PostForm.Get("service"))
+				fmt.Fprint(w, `{"access_token":"abc123"}`)
+			},
+		},
+		{
+			name:        "oauth2 refresh token",
+			credentials: Credentials{IdentityToken: "refresh"},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "POST", r.Method)
+				require.NoError(t, r.ParseForm())
+				assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+				assert.Equal(t, "refresh", r.PostForm.Get("refresh_token"))
+				fmt.Fprint(w, `{"access_token":"abc123"}`)
+			},
+		},
+		{
+			name:        "fallback to get",
+			credentials: Credentials{Username: "user", Password: "secret"},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "POST" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				username, password, ok := r.BasicAuth()
+				assert.True(t, ok)
+				assert.Equal(t, "user", username)
+				assert.Equal(t, "secret", password)
+				assert.Equal(t, "repository:private:pull", r.URL.Query().Get("scope"))
+				fmt.Fprint(w, `{"token":"abc123"}`)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+
+			ta := NewTokenAuthenticatorWithCredentials(tc.credentials).(*tokenAuthenticator)
+			key.realm = srv.URL
+			tok, err := ta.requestToken(context.Background(), key)
+			require.NoError(t, err)
+			assert.Equal(t, "abc123", tok.value)
+		})
+	}
+}
+
+func TestAutoAuthenticator_DetectsScheme(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if r.Method == "POST" {
+			require.NoError(t, r.ParseForm())
+			username, password = r.PostForm.Get("username"), r.PostForm.Get("password")
+		}
+
+		if username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `{"token":"abc123"}`)
+	}))
+	defer tokenSrv.Close()
+
+	testCases := []struct {
+		name       string
+		challenge  string
+		authorized func(r *http.Request) bool
+	}{
+		{
+			name:      "basic",
+			challenge: `Basic realm="registry"`,
+			authorized: func(r *http.Request) bool {
+				username, password, ok := r.BasicAuth()
+				return ok && username == "user" && password == "secret"
+			},
+		},
+		{
+			name:      "bearer",
+			challenge: fmt.Sprintf(`Basic realm="registry", Bearer realm="%s",service="registry",scope="repository:e2e:pull"`, tokenSrv.URL),
+			authorized: func(r *http.Request) bool {
+				return r.Header.Get("Authorization") == "Bearer abc123"
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tc.authorized(r) {
+					w.Header().Set("Www-Authenticate", tc.challenge)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				fmt.Fprint(w, `{"tags":["latest"]}`)
+			}))
+			defer srv.Close()
+
+			reg := New(Options{
+				Authenticator: NewAuthenticator(Credentials{Username: "user", Password: "secret"}),
+				Client:        srv.Client(),
+				Domain:        strings.TrimPrefix(srv.URL, "http://"),
+				Protocol:      "http",
+			})
+			tags, err := reg.Repository("e2e").Tags().GetAll()
+			require.NoError(t, err)
+			assert.Equal(t, []string{"latest"}, tags)
+		})
+	}
+}
+
+func TestTokenAuthenticator_RequestToken_MultipleScopes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"repository:a:pull,push", "repository:b:pull"}, r.URL.Query()["scope"])
+		fmt.Fprint(w, `{"token":"abc123"}`)
+	}))
+	defer srv.Close()
+
+	ta := NewTokenAuthenticator().(*tokenAuthenticator)
+	tok, err := ta.requestToken(context.Background(), tokenKey{realm: srv.URL, scope: "repository:a:pull,push repository:b:pull", service: "registry"})
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", tok.value)
+}
+
+func TestAutoAuthenticator_PingsOnceWithClient(t *testing.T) {
+	var pings int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			atomic.AddInt32(&pings, 1)
+			w.Header().Set("Www-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `{"tags":["latest"]}`)
+	}))
+	defer srv.Close()
+
+	// The client of the test server trusts its certificate. A default http.Client would fail to ping the registry.
+	reg := New(Options{
+		Authenticator: NewAuthenticatorWithOptions(Credentials{Username: "user", Password: "secret"}, AuthenticatorOptions{Client: srv.Client()}),
+		Client:        srv.Client(),
+		Domain:        strings.TrimPrefix(srv.URL, "https://"),
+		Protocol:      "https",
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tags, err := reg.Repository("e2e").Tags().GetAll()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"latest"}, tags)
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+}
+
+func TestRegistry_New_PingsWithClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tags":["latest"]}`)
+	}))
+	defer srv.Close()
+
+	reg := New(Options{
+		Client:   srv.Client(),
+		Domain:   strings.TrimPrefix(srv.URL, "https://"),
+		Protocol: "https",
+	})
+	tags, err := reg.Repository("e2e").Tags().GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, tags)
+}
+
+// flakyKeychain fails the first lookup and returns credentials afterwards.
+type flakyKeychain struct {
+	lookups int
+}
+
+func (k *flakyKeychain) Credentials(domain string) (Credentials, error) {
+	k.lookups++
+	if k.lookups == 1 {
+		return Credentials{}, fmt.Errorf("credential helper timed out")
+	}
+
+	return Credentials{Username: "user", Password: "secret"}, nil
+}
+
+func TestKeychainAuthenticator_RetriesFailedLookup(t *testing.T) {
+	k := &flakyKeychain{}
+	auth := NewKeychainAuthenticator(k, "registry.example.com")
+	r, err := http.NewRequest("GET", "https://registry.example.com/v2/e2e/tags/list", nil)
+	require.NoError(t, err)
+
+	assert.Error(t, auth.HandleRequest(r))
+	_, err = auth.(*keychainAuthenticator).authenticator()
+	require.NoError(t, err)
+	_, err = auth.(*keychainAuthenticator).authenticator()
+	require.NoError(t, err)
+	assert.Equal(t, 2, k.lookups)
+}
+
+func TestTokenAuthenticator_RemovesExpiredTokens(t *testing.T) {
+	ta := NewTokenAuthenticator().(*tokenAuthenticator)
+	expired := tokenKey{realm: "https://auth.example.com/token", scope: "repository:a:pull", service: "registry"}
+	valid := tokenKey{realm: "https://auth.example.com/token", scope: "repository:b:pull", service: "registry"}
+	ra, err := http.NewRequest("GET", "https://registry.example.com/v2/a/tags/list", nil)
+	require.NoError(t, err)
+	rb, err := http.NewRequest("GET", "https://registry.example.com/v2/b/tags/list", nil)
+	require.NoError(t, err)
+
+	ta.storeToken(ra, expired, token{expiresAt: time.Now().Add(-time.Minute), value: "a"})
+	ta.storeToken(rb, valid, token{expiresAt: time.Now().Add(time.Minute), value: "b"})
+	assert.Equal(t, map[string]tokenKey{requestKey(rb): valid}, ta.keys)
+	assert.Len(t, ta.tokens, 1)
+}
@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"context"
+	_ "crypto/sha256" // register the hash function used by digests
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ErrDigestMismatch indicates that the digest of content received from the registry does not match the expected digest.
+var ErrDigestMismatch = fmt.Errorf("digest of content does not match expected digest")
+
+// Descriptor describes a piece of content stored in a registry.
+type Descriptor struct {
+	Digest    string
+	MediaType string
+	Size      int64
+}
+
+// BlobService exposes the blobs, e.g. layers and configs, in a repository.
+type BlobService struct {
+	r    *Requester
+	repo *Repository
+}
+
+// Get returns the content of a blob.
+// The caller has to close the returned ReadCloser.
+// The content is not verified against the digest. Use Open if verification is needed.
+func (b *BlobService) Get(dgst string) (io.ReadCloser, error) {
+	return b.GetContext(context.Background(), dgst)
+}
+
+// GetContext returns the content of a blob.
+// The context controls the lifetime of the request, including reading the content.
+func (b *BlobService) GetContext(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	resp, err := b.send(ctx, "GET", dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Open returns the content of a blob and verifies it while it is being read.
+// Read returns ErrDigestMismatch instead of io.EOF if the content does not match the digest.
+// The caller has to close the returned ReadCloser.
+func (b *BlobService) Open(dgst string) (io.ReadCloser, error) {
+	return b.OpenContext(context.Background(), dgst)
+}
+
+// OpenContext returns the content of a blob and verifies it while it is being read.
+// The context controls the lifetime of the request, including reading the content.
+func (b *BlobService) OpenContext(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing digest '%s'", dgst)
+	}
+
+	resp, err := b.send(ctx, "GET", dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifyingReader{rc: resp.Body, verifier: d.Verifier()}, nil
+}
+
+// Stat queries the registry for the size and media type of a blob without downloading it.
+func (b *BlobService) Stat(dgst string) (Descriptor, error) {
+	return b.StatContext(context.Background(), dgst)
+}
+
+// StatContext queries the registry for the size and media type of a blob without downloading it.
+// The context controls the lifetime of the request.
+func (b *BlobService) StatContext(ctx context.Context, dgst string) (Descriptor, error) {
+	var desc Descriptor
+	resp, err := b.send(ctx, "HEAD", dgst)
+	if err != nil {
+		return desc, err
+	}
+
+	resp.Body.Close()
+	desc.Digest = dgst
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		desc.Digest = d
+	}
+
+	desc.MediaType = resp.Header.Get("Content-Type")
+	desc.Size, err = contentLength(resp)
+	if err != nil {
+		return desc, errors.Wrapf(err, "reading size of blob '%s'", dgst)
+	}
+
+	return desc, nil
+}
+
+// contentLength returns the size of the content of a response.
+// It falls back to the Content-Length header because the body of a HEAD response is always empty.
+func contentLength(resp *http.Response) (int64, error) {
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+func (b *BlobService) send(ctx context.Context, method, dgst string) (*http.Response, error) {
+	path := fmt.Sprintf("/blobs/%s", dgst)
+	req, err := b.r.NewRequestContext(ctx, method, b.repo.httpPath(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.r.SendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkResponse(resp, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading blob '%s'", dgst)
+	}
+
+	return resp, nil
+}
+
+type verifyingReader struct {
+	rc       io.ReadCloser
+	verifier digest.Verifier
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.verifier.Write(p[:n])
+	if err == io.EOF && !v.verifier.Verified() {
+		return n, ErrDigestMismatch
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.rc.Close()
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	readingTheConfigBlobOfResult []byte
+)
+
+// newTestRegistry starts a registry that answers requests with h.
+// The registry responds to pings of the base endpoint "/v2/" with status 200.
+func newTestRegistry(t *testing.T, h http.Handler) (*Registry, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+	reg := New(Options{
+		Client:   srv.Client(),
+		Domain:   strings.TrimPrefix(srv.URL, "http://"),
+		Protocol: "http",
+	})
+	return reg, srv.Close
+}
+
+func TestBlobService_Stat(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HEAD", r.Method)
+		assert.Equal(t, "/v2/e2e/blobs/sha256:abc", r.URL.Path)
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", "sha256:abc")
+	}))
+	defer closeFunc()
+
+	desc, err := reg.Repository("e2e").Blobs().Stat("sha256:abc")
+	require.NoError(t, err)
+	assert.Equal(t, Descriptor{Digest: "sha256:abc", MediaType: "application/octet-stream", Size: 1234}, desc)
+}
+
+func TestBlobService_Stat_NotFound(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.NotFoundHandler())
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Blobs().Stat("sha256:abc")
+	assert.True(t, errors.Is(err, ErrResourceNotFound))
+}
+
+func TestBlobService_Open(t *testing.T) {
+	content := "layer content"
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer closeFunc()
+
+	rc, err := reg.Repository("e2e").Blobs().Open(digest.FromString(content).String())
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestBlobService_Open_DigestMismatch(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tampered content")
+	}))
+	defer closeFunc()
+
+	rc, err := reg.Repository("e2e").Blobs().Open(digest.FromString("layer content").String())
+	require.NoError(t, err)
+	defer rc.Close()
+	_, err = ioutil.ReadAll(rc)
+	assert.Equal(t, ErrDigestMismatch, err)
+}
+
+func readingTheConfigBlobOf(imageName string) error {
+	domain, path, tag, _, err := ParseImageName(imageName)
+	if err != nil {
+		return err
+	}
+
+	reg := New(Options{
+		Client:   DefaultClient(),
+		Domain:   domain,
+		Protocol: "http",
+	})
+	repository := reg.Repository(path)
+	image, err := repository.Images().GetByTag(tag)
+	if err != nil {
+		return err
+	}
+
+	m, err := repository.Manifests().Get(image.Platforms[0].Digest)
+	if err != nil {
+		return err
+	}
+
+	rc, err := repository.Blobs().Open(m.Config.Digest.String())
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	readingTheConfigBlobOfResult, err = ioutil.ReadAll(rc)
+	return err
+}
+
+func theBlobContains(s string) error {
+	if !strings.Contains(string(readingTheConfigBlobOfResult), s) {
+		return fmt.Errorf("expected blob to contain '%s'", s)
+	}
+
+	return nil
+}
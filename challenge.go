@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// token68Regexp matches the token68 syntax of a challenge that has no parameters, e.g. `Negotiate dG9rZW4=`.
+var token68Regexp = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*[ \t]*(,|$)`)
+
+// challenge is an authentication challenge sent by a registry in the WWW-Authenticate header.
+// See https://tools.ietf.org/html/rfc7235#section-4.1.
+type challenge struct {
+	// parameters stores all values of a parameter in the order they appear in the challenge.
+	// Names of parameters are always lower case.
+	parameters map[string][]string
+	// scheme is always lower case.
+	scheme string
+}
+
+// parameter returns the first value of the parameter name.
+func (c challenge) parameter(name string) string {
+	values := c.parameters[name]
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// challengesFromResponse returns the challenges of all WWW-Authenticate headers in a response.
+func challengesFromResponse(resp *http.Response) []challenge {
+	var challenges []challenge
+	for _, h := range resp.Header[http.CanonicalHeaderKey("www-authenticate")] {
+		challenges = append(challenges, parseChallenges(h)...)
+	}
+
+	return challenges
+}
+
+// findChallenge returns the first challenge with the given scheme.
+func findChallenge(challenges []challenge, scheme string) (challenge, bool) {
+	for _, c := range challenges {
+		if c.scheme == scheme {
+			return c, true
+		}
+	}
+
+	return challenge{}, false
+}
+
+// parseChallenges parses the value of a WWW-Authenticate header as described in https://tools.ietf.org/html/rfc7235#section-4.1.
+// A header can contain multiple challenges, e.g. `Basic realm="registry", Bearer realm="https://auth.example.com/token"`.
+// Parameters can be tokens or quoted strings that contain commas, equal signs and escaped characters.
+func parseChallenges(h string) []challenge {
+	var challenges []challenge
+	s := h
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return challenges
+		}
+
+		var name string
+		name, s = readToken(s)
+		if name == "" {
+			// Malformed header. Return what has been parsed so far.
+			return challenges
+		}
+
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "=") && len(challenges) > 0 {
+			var value string
+			value, s = readValue(strings.TrimLeft(s[1:], " \t"))
+			c := challenges[len(challenges)-1]
+			name = strings.ToLower(name)
+			c.parameters[name] = append(c.parameters[name], value)
+			continue
+		}
+
+		challenges = append(challenges, challenge{parameters: map[string][]string{}, scheme: strings.ToLower(name)})
+		if loc := token68Regexp.FindStringIndex(s); loc != nil {
+			// The value of token68 is not needed by any supported scheme.
+			s = s[loc[1]:]
+		}
+	}
+}
+
+// readToken reads a token as defined in https://tools.ietf.org/html/rfc7230#section-3.2.6.
+func readToken(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !isTokenChar(r)
+	})
+	if i == -1 {
+		return s, ""
+	}
+
+	return s[:i], s[i:]
+}
+
+// readValue reads a token or a quoted string.
+// Escaped characters in a quoted string are unescaped.
+func readValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return readToken(s)
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return value.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+
+		value.WriteByte(s[i])
+	}
+
+	// Missing closing quote. Treat the rest of the header as the value.
+	return value.String(), ""
+}
+
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChallenges(t *testing.T) {
+	testCases := []struct {
+		header string
+		want   []challenge
+	}{
+		{
+			header: `Basic realm="Registry Realm"`,
+			want:   []challenge{{parameters: map[string][]string{"realm": {"Registry Realm"}}, scheme: "basic"}},
+		},
+		{
+			header: `Bearer realm="https://auth.example.com/token?a=b",service="registry",scope="repository:a:pull,push"`,
+			want: []challenge{{
+				parameters: map[string][]string{"realm": {"https://auth.example.com/token?a=b"}, "scope": {"repository:a:pull,push"}, "service": {"registry"}},
+				scheme:     "bearer",
+			}},
+		},
+		{
+			header: `Basic realm="basic, realm", Bearer realm="https://auth.example.com/token", service=registry`,
+			want: []challenge{
+				{parameters: map[string][]string{"realm": {"basic, realm"}}, scheme: "basic"},
+				{parameters: map[string][]string{"realm": {"https://auth.example.com/token"}, "service": {"registry"}}, scheme: "bearer"},
+			},
+		},
+		{
+			header: `Bearer realm="https://auth.example.com/\\token\"",scope="repository:a:pull",scope="repository:b:pull"`,
+			want: []challenge{{
+				parameters: map[string][]string{"realm": {`https://auth.example.com/\token"`}, "scope": {"repository:a:pull", "repository:b:pull"}},
+				scheme:     "bearer",
+			}},
+		},
+		{
+			header: `Negotiate dG9rZW4=, Basic realm="registry"`,
+			want: []challenge{
+				{parameters: map[string][]string{}, scheme: "negotiate"},
+				{parameters: map[string][]string{"realm": {"registry"}}, scheme: "basic"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.header, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseChallenges(tc.header))
+		})
+	}
+}
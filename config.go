@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/pkg/errors"
+)
+
+// ImageConfig is the configuration of an image.
+// See https://github.com/opencontainers/image-spec/blob/master/config.md.
+type ImageConfig struct {
+	Architecture string          `json:"architecture"`
+	Author       string          `json:"author,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	Created      time.Time       `json:"created"`
+	History      []History       `json:"history,omitempty"`
+	OS           string          `json:"os"`
+	OSFeatures   []string        `json:"os.features,omitempty"`
+	OSVersion    string          `json:"os.version,omitempty"`
+	RootFS       RootFS          `json:"rootfs"`
+	Variant      string          `json:"variant,omitempty"`
+}
+
+// ContainerConfig is the configuration of containers created from an image.
+type ContainerConfig struct {
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	User         string              `json:"User,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+}
+
+// History describes how a layer of an image was created.
+type History struct {
+	Author    string    `json:"author,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// EmptyLayer is true if the step did not create a layer, e.g. ENV in a Dockerfile.
+	EmptyLayer bool `json:"empty_layer,omitempty"`
+}
+
+// RootFS references the layers of an image by the digests of their uncompressed content.
+type RootFS struct {
+	DiffIDs []string `json:"diff_ids"`
+	Type    string   `json:"type"`
+}
+
+// GetConfig returns the configuration of an image for one platform.
+// Pass one of the entries in Image.Platforms.
+func (i *ImageService) GetConfig(p Platform) (ImageConfig, error) {
+	return i.GetConfigContext(context.Background(), p)
+}
+
+// GetConfigContext returns the configuration of an image for one platform.
+// The context controls the lifetime of the requests.
+// The configuration of an image with a manifest of schema v1 is derived from its history, see ConvertSchema1().
+func (i *ImageService) GetConfigContext(ctx context.Context, p Platform) (ImageConfig, error) {
+	m, _, _, err := i.getManifest(ctx, p.Digest)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+
+	switch manifest := m.(type) {
+	case *schema2.DeserializedManifest, *ocischema.DeserializedManifest:
+		return i.getConfigBlob(ctx, configDigest(manifest))
+	case *schema1.SignedManifest:
+		var config ImageConfig
+		_, data, err := ConvertSchema1(manifest)
+		if err != nil {
+			return config, errors.Wrapf(err, "converting manifest '%s'", p.Digest)
+		}
+
+		err = json.Unmarshal(data, &config)
+		return config, errors.Wrapf(err, "unmarshalling config of manifest '%s'", p.Digest)
+	case *manifestlist.DeserializedManifestList:
+		return ImageConfig{}, fmt.Errorf("manifest '%s' is a list of manifests and has no config", p.Digest)
+	default:
+		return ImageConfig{}, ErrSchemaUnknown
+	}
+}
+
+// configDigest returns the digest of the config of a manifest of schema v2 or an OCI image manifest.
+// Both types of manifests list the config as their first reference.
+func configDigest(m distribution.Manifest) string {
+	return m.References()[0].Digest.String()
+}
+
+// getConfigBlob downloads and decodes the configuration blob of an image.
+// The content of the blob is verified against its digest.
+func (i *ImageService) getConfigBlob(ctx context.Context, dgst string) (ImageConfig, error) {
+	var config ImageConfig
+	data, err := i.readBlob(ctx, dgst)
+	if err != nil {
+		return config, errors.Wrap(err, "reading config of image")
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, errors.Wrapf(err, "unmarshalling config '%s'", dgst)
+	}
+
+	return config, nil
+}
+
+// readBlob downloads a small blob, e.g. a config, into memory and verifies it against its digest.
+func (i *ImageService) readBlob(ctx context.Context, dgst string) ([]byte, error) {
+	rc, err := i.repo.Blobs().OpenContext(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading blob '%s'", dgst)
+	}
+
+	return data, nil
+}
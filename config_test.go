@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageService_GetConfig(t *testing.T) {
+	config := `{
+		"architecture": "arm64",
+		"os": "linux",
+		"created": "2019-03-04T10:11:12Z",
+		"config": {
+			"Env": ["PATH=/usr/bin"],
+			"Entrypoint": ["/app"],
+			"Cmd": ["--help"],
+			"Labels": {"org.opencontainers.image.revision": "abc"},
+			"User": "nobody",
+			"ExposedPorts": {"8080/tcp": {}}
+		},
+		"history": [{"created": "2019-03-04T10:11:12Z", "created_by": "COPY app /app"}],
+		"rootfs": {"type": "layers", "diff_ids": ["sha256:1111111111111111111111111111111111111111111111111111111111111111"]}
+	}`
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"digest":"%s"},"layers":[]}`, digest.FromString(config))
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/e2e/manifests/" + digest.FromString(manifest).String():
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, manifest)
+		case "/v2/e2e/blobs/" + digest.FromString(config).String():
+			fmt.Fprint(w, config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer closeFunc()
+
+	c, err := reg.Repository("e2e").Images().GetConfig(Platform{Digest: digest.FromString(manifest).String()})
+	require.NoError(t, err)
+	assert.Equal(t, "arm64", c.Architecture)
+	assert.Equal(t, time.Date(2019, 3, 4, 10, 11, 12, 0, time.UTC), c.Created)
+	assert.Equal(t, []string{"PATH=/usr/bin"}, c.Config.Env)
+	assert.Equal(t, []string{"/app"}, c.Config.Entrypoint)
+	assert.Equal(t, []string{"--help"}, c.Config.Cmd)
+	assert.Equal(t, "abc", c.Config.Labels["org.opencontainers.image.revision"])
+	assert.Equal(t, "nobody", c.Config.User)
+	assert.Contains(t, c.Config.ExposedPorts, "8080/tcp")
+	require.Len(t, c.History, 1)
+	assert.Equal(t, "COPY app /app", c.History[0].CreatedBy)
+	assert.Equal(t, []string{"sha256:1111111111111111111111111111111111111111111111111111111111111111"}, c.RootFS.DiffIDs)
+}
+
+func TestImageService_GetConfig_Schema1(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, schema1Handler(t, newTestSchema1Manifest(t)))
+	defer closeFunc()
+
+	c, err := reg.Repository("e2e").Images().GetConfig(Platform{Digest: "old"})
+	require.NoError(t, err)
+	assert.Equal(t, "arm", c.Architecture)
+	assert.Equal(t, []string{"sh"}, c.Config.Cmd)
+	assert.Len(t, c.History, 3)
+	assert.Equal(t, "layers", c.RootFS.Type)
+}
@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Reference identifies an image in a repository by its tag or its digest.
+type Reference struct {
+	// Digest identifies the image. It takes precedence over Tag.
+	Digest     string
+	Repository *Repository
+	Tag        string
+}
+
+func (r Reference) String() string {
+	if r.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", r.Repository.Domain(), r.Repository.Name(), r.Digest)
+	}
+
+	return fmt.Sprintf("%s/%s:%s", r.Repository.Domain(), r.Repository.Name(), r.Tag)
+}
+
+func (r Reference) ref() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+
+	return r.Tag
+}
+
+// CopyOptions configure how an image is copied.
+type CopyOptions struct {
+	// Platforms limits the copy of a manifest list or an OCI image index to the manifests of these platforms.
+	// A platform matches if its architecture and operating system are equal and, if set, its variant is equal.
+	// Platforms are normalized with NormalizePlatform() before they are compared, so "linux/arm64/v8", as returned by ParsePlatform(),
+	// matches an entry for "arm64" that leaves out the variant.
+	// The copy of the manifest list has a different digest than the source if a platform is left out.
+	// All platforms are copied if Platforms is empty.
+	Platforms []Platform
+}
+
+// Copy copies an image, including all manifests referenced by a manifest list and all blobs, from src to dst.
+// The repositories of src and dst can be in different registries.
+// dst is tagged with dst.Tag. Set only dst.Repository to copy the image without a tag.
+// It returns the digest of the image in dst.
+//
+// Blobs that already exist in dst are skipped.
+// Blobs are mounted instead of uploaded if src and dst are in the same registry.
+// The manifests are copied unchanged, so the digest of the copy is equal to the digest of src
+// unless CopyOptions.Platforms leaves out a platform.
+// Images with a manifest of schema v1 cannot be copied and return an error that wraps ErrSchemaV1NotSupported.
+func Copy(src, dst Reference, opts CopyOptions) (string, error) {
+	return CopyContext(context.Background(), src, dst, opts)
+}
+
+// CopyContext copies an image from src to dst.
+// The context controls the lifetime of all requests.
+func CopyContext(ctx context.Context, src, dst Reference, opts CopyOptions) (string, error) {
+	c := &copier{dst: dst.Repository, opts: opts, src: src.Repository}
+	dgst, err := c.copyManifest(ctx, src.ref(), dst.Tag, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "copying '%s'", src)
+	}
+
+	return dgst, nil
+}
+
+type copier struct {
+	dst  *Repository
+	opts CopyOptions
+	src  *Repository
+}
+
+// copyManifest copies the manifest identified by ref and everything it references.
+// The manifest is uploaded with tag or, if tag is empty, with its digest.
+// The platforms of a manifest list are only filtered at the top level.
+func (c *copier) copyManifest(ctx context.Context, ref, tag string, filter bool) (string, error) {
+	m, _, _, err := c.src.Images().getManifest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := m.(*schema1.SignedManifest); ok {
+		// The digest of a manifest of schema v1 is computed from its payload without the signatures, which cannot be uploaded unchanged.
+		return "", errors.Wrapf(ErrSchemaV1NotSupported, "copying manifest '%s'", ref)
+	}
+
+	if list, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		var descriptors []manifestlist.ManifestDescriptor
+		for _, d := range list.Manifests {
+			if filter && !includesPlatform(c.opts.Platforms, d.Platform) {
+				continue
+			}
+
+			_, err := c.copyManifest(ctx, d.Digest.String(), "", false)
+			if err != nil {
+				return "", err
+			}
+
+			descriptors = append(descriptors, d)
+		}
+
+		if len(descriptors) == 0 {
+			return "", fmt.Errorf("manifest list '%s' does not contain any of the requested platforms", ref)
+		}
+
+		if len(descriptors) != len(list.Manifests) {
+			m, err = manifestlist.FromDescriptors(descriptors)
+			if err != nil {
+				return "", errors.Wrap(err, "creating manifest list")
+			}
+		}
+	} else {
+		for _, d := range m.References() {
+			err := c.copyBlob(ctx, d)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if tag == "" {
+		_, payload, err := m.Payload()
+		if err != nil {
+			return "", errors.Wrap(err, "reading payload of manifest")
+		}
+
+		tag = digest.FromBytes(payload).String()
+	}
+
+	return c.dst.Manifests().PutContext(ctx, tag, m)
+}
+
+// copyBlob copies a blob unless it already exists in the destination.
+func (c *copier) copyBlob(ctx context.Context, d distribution.Descriptor) error {
+	dgst := d.Digest.String()
+	_, err := c.dst.Blobs().StatContext(ctx, dgst)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, ErrResourceNotFound) {
+		return err
+	}
+
+	var w *BlobWriter
+	if c.src.Domain() == c.dst.Domain() {
+		var mounted bool
+		w, mounted, err = c.dst.Blobs().MountContext(ctx, dgst, c.src.Name())
+		if err != nil {
+			return err
+		}
+
+		if mounted {
+			return nil
+		}
+	} else {
+		w, err = c.dst.Blobs().CreateContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	rc, err := c.src.Blobs().OpenContext(ctx, dgst)
+	if err != nil {
+		w.Cancel()
+		return err
+	}
+
+	defer rc.Close()
+	_, err = w.commit(rc, d.Size, dgst)
+	if err != nil {
+		w.Cancel()
+		return err
+	}
+
+	return nil
+}
+
+// includesPlatform reports whether the platform of a manifest in a manifest list is one of the platforms in want.
+// All platforms are included if want is empty.
+func includesPlatform(want []Platform, spec manifestlist.PlatformSpec) bool {
+	if len(want) == 0 {
+		return true
+	}
+
+	p := NormalizePlatform(platformFromSpec(spec))
+	for _, w := range want {
+		anyVariant := w.Variant == ""
+		w = NormalizePlatform(w)
+		if w.Architecture == p.Architecture && w.OS == p.OS && (anyVariant || w.Variant == p.Variant) {
+			return true
+		}
+	}
+
+	return false
+}
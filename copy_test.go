@@ -0,0 +1,347 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	memoryUploadPath   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/(.*)$`)
+	memoryResourcePath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/(.+)$`)
+)
+
+type memoryManifest struct {
+	data      []byte
+	mediaType string
+}
+
+// memoryRegistry is a registry that stores manifests and blobs in memory.
+type memoryRegistry struct {
+	blobs     map[string][]byte
+	manifests map[string]memoryManifest
+	mounts    int
+	mutex     sync.Mutex
+	uploads   map[string][]byte
+	uploaded  int
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{blobs: map[string][]byte{}, manifests: map[string]memoryManifest{}, uploads: map[string][]byte{}}
+}
+
+func (m *memoryRegistry) addBlob(repo string, data []byte) string {
+	dgst := digest.FromBytes(data).String()
+	m.blobs[repo+"@"+dgst] = data
+	return dgst
+}
+
+func (m *memoryRegistry) addManifest(repo, tag, mediaType string, data []byte) string {
+	dgst := digest.FromBytes(data).String()
+	m.manifests[repo+"@"+dgst] = memoryManifest{data: data, mediaType: mediaType}
+	if tag != "" {
+		m.manifests[repo+":"+tag] = memoryManifest{data: data, mediaType: mediaType}
+	}
+
+	return dgst
+}
+
+func (m *memoryRegistry) key(repo, ref string) string {
+	if strings.Contains(ref, ":") {
+		return repo + "@" + ref
+	}
+
+	return repo + ":" + ref
+}
+
+func (m *memoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if match := memoryUploadPath.FindStringSubmatch(r.URL.Path); match != nil {
+		m.serveUpload(w, r, match[1], match[2], body)
+		return
+	}
+
+	match := memoryResourcePath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	repo, kind, ref := match[1], match[2], match[3]
+	if kind == "blobs" {
+		data, ok := m.blobs[repo+"@"+ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Header().Set("Docker-Content-Digest", ref)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		mf, ok := m.manifests[m.key(repo, ref)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", mf.mediaType)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(mf.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(mf.data).String())
+		if r.Method == "GET" {
+			w.Write(mf.data)
+		}
+	case "PUT":
+		tag := ref
+		if strings.Contains(ref, ":") {
+			tag = ""
+		}
+
+		dgst := m.addManifest(repo, tag, r.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (m *memoryRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string, body []byte) {
+	switch r.Method {
+	case "POST":
+		mount, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if data, ok := m.blobs[from+"@"+mount]; ok {
+			m.blobs[repo+"@"+mount] = data
+			m.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		id = fmt.Sprintf("%d", len(m.uploads))
+		m.uploads[id] = []byte{}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+	case "PATCH":
+		m.uploads[id] = append(m.uploads[id], body...)
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		data := append(m.uploads[id], body...)
+		dgst := r.URL.Query().Get("digest")
+		if digest.FromBytes(data).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		m.blobs[repo+"@"+dgst] = data
+		m.uploaded++
+		delete(m.uploads, id)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		delete(m.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// addTestImage adds a manifest of schema v2 with a config and one layer to the repository.
+func (m *memoryRegistry) addTestImage(repo, tag, arch string) (string, int) {
+	config := []byte(fmt.Sprintf(`{"architecture":"%s","os":"linux"}`, arch))
+	layer := []byte("layer of " + arch)
+	data := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"%s","digest":"%s","size":%d},"layers":[{"mediaType":"%s","digest":"%s","size":%d}]}`,
+		schema2.MediaTypeManifest, schema2.MediaTypeImageConfig, m.addBlob(repo, config), len(config), schema2.MediaTypeLayer, m.addBlob(repo, layer), len(layer)))
+	return m.addManifest(repo, tag, schema2.MediaTypeManifest, data), len(data)
+}
+
+// addTestIndex adds a manifest list with an image for amd64 and an image for arm64 to the repository.
+func (m *memoryRegistry) addTestIndex(repo, tag string) string {
+	amd64, amd64Size := m.addTestImage(repo, "", "amd64")
+	arm64, arm64Size := m.addTestImage(repo, "", "arm64")
+	data := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[{"mediaType":"%s","digest":"%s","size":%d,"platform":{"architecture":"amd64","os":"linux"}},{"mediaType":"%s","digest":"%s","size":%d,"platform":{"architecture":"arm64","os":"linux","variant":"v8"}}]}`,
+		manifestlist.MediaTypeManifestList, schema2.MediaTypeManifest, amd64, amd64Size, schema2.MediaTypeManifest, arm64, arm64Size))
+	return m.addManifest(repo, tag, manifestlist.MediaTypeManifestList, data)
+}
+
+func TestCopy_BetweenRegistries(t *testing.T) {
+	srcMem := newMemoryRegistry()
+	srcDigest := srcMem.addTestIndex("src", "latest")
+	srcReg, closeSrc := newTestRegistry(t, srcMem)
+	defer closeSrc()
+	dstMem := newMemoryRegistry()
+	dstReg, closeDst := newTestRegistry(t, dstMem)
+	defer closeDst()
+
+	dgst, err := Copy(
+		Reference{Repository: srcReg.Repository("src"), Tag: "latest"},
+		Reference{Repository: dstReg.Repository("dst"), Tag: "v1"},
+		CopyOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest, dgst)
+	assert.Equal(t, srcMem.manifests["src:latest"], dstMem.manifests["dst:v1"])
+	assert.Len(t, dstMem.blobs, 4)
+	assert.Equal(t, 4, dstMem.uploaded)
+	assert.Equal(t, 0, dstMem.mounts)
+
+	img, err := dstReg.Repository("dst").Images().GetByTag("v1")
+	require.NoError(t, err)
+	assert.Len(t, img.Platforms, 2)
+}
+
+func TestCopy_BetweenRegistries_TokenAuth(t *testing.T) {
+	srcMem := newMemoryRegistry()
+	srcDigest := srcMem.addTestIndex("src", "latest")
+	srcReg, closeSrc := newTokenTestRegistry(t, srcMem)
+	defer closeSrc()
+	dstMem := newMemoryRegistry()
+	dstReg, closeDst := newTokenTestRegistry(t, dstMem)
+	defer closeDst()
+
+	dgst, err := Copy(
+		Reference{Repository: srcReg.Repository("src"), Tag: "latest"},
+		Reference{Repository: dstReg.Repository("dst"), Tag: "v1"},
+		CopyOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest, dgst)
+	assert.Equal(t, srcMem.manifests["src:latest"], dstMem.manifests["dst:v1"])
+	assert.Len(t, dstMem.blobs, 4)
+}
+
+func TestCopy_SameRegistryPlatforms(t *testing.T) {
+	mem := newMemoryRegistry()
+	srcDigest := mem.addTestIndex("staging/app", "latest")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	dgst, err := Copy(
+		Reference{Repository: reg.Repository("staging/app"), Tag: "latest"},
+		Reference{Repository: reg.Repository("prod/app"), Tag: "latest"},
+		CopyOptions{Platforms: []Platform{{Architecture: "arm64", OS: "linux"}}},
+	)
+	require.NoError(t, err)
+	assert.NotEqual(t, srcDigest, dgst)
+	assert.Equal(t, 2, mem.mounts)
+	assert.Equal(t, 0, mem.uploaded)
+
+	img, err := reg.Repository("prod/app").Images().GetByDigest(dgst)
+	require.NoError(t, err)
+	require.Len(t, img.Platforms, 1)
+	assert.Equal(t, "arm64", img.Platforms[0].Architecture)
+}
+
+func TestCopy_SkipsExistingBlobs(t *testing.T) {
+	srcMem := newMemoryRegistry()
+	srcDigest, _ := srcMem.addTestImage("src", "latest", "amd64")
+	srcReg, closeSrc := newTestRegistry(t, srcMem)
+	defer closeSrc()
+	dstMem := newMemoryRegistry()
+	dstMem.addBlob("dst", []byte("layer of amd64"))
+	dstReg, closeDst := newTestRegistry(t, dstMem)
+	defer closeDst()
+
+	dgst, err := Copy(
+		Reference{Repository: srcReg.Repository("src"), Digest: srcDigest},
+		Reference{Repository: dstReg.Repository("dst")},
+		CopyOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest, dgst)
+	assert.Equal(t, 1, dstMem.uploaded)
+	assert.Contains(t, dstMem.manifests, "dst@"+srcDigest)
+}
+
+func TestCopy_NoMatchingPlatform(t *testing.T) {
+	mem := newMemoryRegistry()
+	mem.addTestIndex("src", "latest")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	_, err := Copy(
+		Reference{Repository: reg.Repository("src"), Tag: "latest"},
+		Reference{Repository: reg.Repository("dst"), Tag: "latest"},
+		CopyOptions{Platforms: []Platform{{Architecture: "s390x", OS: "linux"}}},
+	)
+	assert.Error(t, err)
+}
+
+func TestIncludesPlatform(t *testing.T) {
+	testCases := []struct {
+		name     string
+		want     Platform
+		spec     manifestlist.PlatformSpec
+		expected bool
+	}{
+		{name: "equal", want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v7"}, expected: true},
+		{name: "any variant", want: Platform{OS: "linux", Architecture: "arm"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}, expected: true},
+		{name: "alias", want: Platform{OS: "linux", Architecture: "aarch64"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}, expected: true},
+		{name: "older variant", want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{name: "default variant", want: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"}, expected: true},
+		{name: "default variant arm", want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm"}, expected: true},
+		{name: "other variant than default", want: Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, spec: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm"}},
+		{name: "other os", want: Platform{OS: "linux", Architecture: "amd64"}, spec: manifestlist.PlatformSpec{OS: "windows", Architecture: "amd64"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, includesPlatform([]Platform{tc.want}, tc.spec))
+		})
+	}
+}
+
+func TestCopy_Schema1(t *testing.T) {
+	testCases := []struct {
+		name    string
+		handler func(signed *schema1.SignedManifest) http.Handler
+	}{
+		{name: "signed", handler: func(signed *schema1.SignedManifest) http.Handler { return schema1Handler(t, signed) }},
+		{name: "unsigned", handler: func(signed *schema1.SignedManifest) http.Handler {
+			return unsignedSchema1Handler(signed, schema1.MediaTypeManifest)
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var puts int32
+			h := tc.handler(newTestSchema1Manifest(t))
+			reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "GET" {
+					atomic.AddInt32(&puts, 1)
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+
+				h.ServeHTTP(w, r)
+			}))
+			defer closeFunc()
+
+			_, err := Copy(
+				Reference{Repository: reg.Repository("src"), Tag: "old"},
+				Reference{Repository: reg.Repository("dst"), Tag: "new"},
+				CopyOptions{},
+			)
+			assert.True(t, errors.Is(err, ErrSchemaV1NotSupported))
+			assert.Equal(t, int32(0), atomic.LoadInt32(&puts))
+		})
+	}
+}
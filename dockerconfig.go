@@ -0,0 +1,208 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dockerHubServerURL is the key under which the Docker CLI stores the credentials of the Docker Hub.
+	dockerHubServerURL = "https://index.docker.io/v1/"
+	// helperTokenUsername is the username returned by a credential helper if the secret is an identity token.
+	helperTokenUsername = "<token>"
+	// helperNotFoundMessage is printed by a credential helper if it does not store credentials for a server.
+	helperNotFoundMessage = "credentials not found in native keychain"
+)
+
+// execCredentialHelper calls a Docker credential helper and returns its output.
+// See https://github.com/docker/docker-credential-helpers for a description of the protocol.
+var execCredentialHelper = func(helper, serverURL string) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.TrimSpace(string(out)) == helperNotFoundMessage {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("credential helper '%s' failed with '%s': %s%s", helper, err, string(out), stderr.String())
+	}
+
+	return out, nil
+}
+
+// A Keychain looks up the credentials of a registry.
+type Keychain interface {
+	// Credentials returns the credentials for the registry at domain.
+	// It returns empty credentials if none are known.
+	Credentials(domain string) (Credentials, error)
+}
+
+// DockerAuthConfig is an entry in the "auths" section of the configuration file of the Docker CLI.
+type DockerAuthConfig struct {
+	// Auth is "username:password" encoded in base64.
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+	Password      string `json:"password"`
+	Username      string `json:"username"`
+}
+
+// DockerConfig is the configuration file of the Docker CLI, usually located at ~/.docker/config.json.
+// It implements Keychain.
+type DockerConfig struct {
+	Auths       map[string]DockerAuthConfig `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+// LoadDockerConfig reads the configuration file of the Docker CLI at path.
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading docker config")
+	}
+
+	c := &DockerConfig{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling docker config '%s'", path)
+	}
+
+	return c, nil
+}
+
+// LoadDefaultDockerConfig reads the configuration file of the Docker CLI from the directory
+// set in the environment variable DOCKER_CONFIG or from ~/.docker.
+// It returns an empty configuration if the file does not exist.
+func LoadDefaultDockerConfig() (*DockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "detecting home directory")
+		}
+
+		dir = filepath.Join(home, ".docker")
+	}
+
+	c, err := LoadDockerConfig(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(errors.Cause(err)) {
+		return &DockerConfig{}, nil
+	}
+
+	return c, err
+}
+
+// Credentials returns the credentials for the registry at domain.
+// Credential helpers take precedence over the entries in "auths".
+func (c *DockerConfig) Credentials(domain string) (Credentials, error) {
+	serverURL := domain
+	if isDockerHub(domain) {
+		serverURL = dockerHubServerURL
+	}
+
+	helper := c.CredsStore
+	if h, ok := c.CredHelpers[domain]; ok {
+		helper = h
+	}
+
+	if helper != "" {
+		return credentialsFromHelper(helper, serverURL)
+	}
+
+	if ac, ok := c.Auths[serverURL]; ok {
+		return ac.credentials()
+	}
+
+	for key, ac := range c.Auths {
+		if normalizeServerURL(key) == domain || (isDockerHub(domain) && isDockerHub(normalizeServerURL(key))) {
+			return ac.credentials()
+		}
+	}
+
+	return Credentials{}, nil
+}
+
+func (ac DockerAuthConfig) credentials() (Credentials, error) {
+	c := Credentials{
+		IdentityToken: ac.IdentityToken,
+		Password:      ac.Password,
+		Username:      ac.Username,
+	}
+	if ac.Auth == "" {
+		return c, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(ac.Auth)
+	if err != nil {
+		return c, errors.Wrap(err, "decoding auth of docker config")
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return c, fmt.Errorf("auth of docker config is not in format 'username:password'")
+	}
+
+	c.Username = parts[0]
+	c.Password = parts[1]
+	return c, nil
+}
+
+type credentialHelperResponse struct {
+	Secret    string
+	ServerURL string
+	Username  string
+}
+
+func credentialsFromHelper(helper, serverURL string) (Credentials, error) {
+	var c Credentials
+	out, err := execCredentialHelper(helper, serverURL)
+	if err != nil || out == nil {
+		return c, err
+	}
+
+	resp := credentialHelperResponse{}
+	err = json.Unmarshal(out, &resp)
+	if err != nil {
+		return c, errors.Wrapf(err, "unmarshalling response of credential helper '%s'", helper)
+	}
+
+	if resp.Username == helperTokenUsername {
+		c.IdentityToken = resp.Secret
+		return c, nil
+	}
+
+	c.Username = resp.Username
+	c.Password = resp.Secret
+	return c, nil
+}
+
+func isDockerHub(domain string) bool {
+	return domain == "docker.io" || domain == "index.docker.io" || domain == "registry-1.docker.io"
+}
+
+// normalizeServerURL removes the scheme and path from a key in "auths".
+func normalizeServerURL(serverURL string) string {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return serverURL
+	}
+
+	return u.Host
+}
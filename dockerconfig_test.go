@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfig_Credentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ="},
+			"https://registry.example.com/v2/": {"identitytoken": "refresh"},
+			"private.example.com": {}
+		},
+		"credHelpers": {"private.example.com": "test"}
+	}`), 0600)
+	require.NoError(t, err)
+
+	c, err := LoadDockerConfig(path)
+	require.NoError(t, err)
+
+	defer func(f func(string, string) ([]byte, error)) { execCredentialHelper = f }(execCredentialHelper)
+	execCredentialHelper = func(helper, serverURL string) ([]byte, error) {
+		assert.Equal(t, "test", helper)
+		assert.Equal(t, "private.example.com", serverURL)
+		return []byte(`{"ServerURL":"private.example.com","Username":"helper","Secret":"helpersecret"}`), nil
+	}
+
+	creds, err := c.Credentials("docker.io")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "user", Password: "secret"}, creds)
+
+	creds, err = c.Credentials("registry.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{IdentityToken: "refresh"}, creds)
+
+	creds, err = c.Credentials("private.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "helper", Password: "helpersecret"}, creds)
+
+	creds, err = c.Credentials("unknown.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{}, creds)
+}
+
+func TestDockerConfig_Credentials_HelperIdentityToken(t *testing.T) {
+	c := &DockerConfig{CredsStore: "test"}
+	defer func(f func(string, string) ([]byte, error)) { execCredentialHelper = f }(execCredentialHelper)
+	execCredentialHelper = func(helper, serverURL string) ([]byte, error) {
+		assert.Equal(t, "https://index.docker.io/v1/", serverURL)
+		return []byte(`{"ServerURL":"https://index.docker.io/v1/","Username":"<token>","Secret":"refresh"}`), nil
+	}
+
+	creds, err := c.Credentials("docker.io")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{IdentityToken: "refresh"}, creds)
+}
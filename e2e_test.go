@@ -65,4 +65,6 @@ func FeatureContext(s *godog.Suite) {
 	s.Step(`^the image "([^"]*)" does not exist$`, theImageDoesNotExist)
 	s.Step(`^listing repositories in "([^"]*)"$`, listingRepositoriesIn)
 	s.Step(`^the list of repositories contains "([^"]*)"$`, theListOfRepositoriesContains)
+	s.Step(`^reading the config blob of "([^"]*)"$`, readingTheConfigBlobOf)
+	s.Step(`^the blob contains "([^"]*)"$`, theBlobContains)
 }
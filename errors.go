@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBodySize limits the number of bytes read from the body of an error response.
+const maxErrorBodySize = 64 * 1024
+
+// ErrorCode is an error code returned by a registry as defined in https://docs.docker.com/registry/spec/api/#errors-2.
+// ErrorCode implements error so that it can be passed to errors.Is() to check if a ResponseError contains the code.
+type ErrorCode string
+
+// Error codes defined by the Docker Registry API V2.
+const (
+	ErrorCodeBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrorCodeBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrorCodeDenied              ErrorCode = "DENIED"
+	ErrorCodeDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrorCodeManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrorCodeManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeManifestUnverified  ErrorCode = "MANIFEST_UNVERIFIED"
+	ErrorCodeNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrorCodeTagInvalid          ErrorCode = "TAG_INVALID"
+	ErrorCodeTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+	ErrorCodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrorCodeUnknown             ErrorCode = "UNKNOWN"
+	ErrorCodeUnsupported         ErrorCode = "UNSUPPORTED"
+)
+
+func (c ErrorCode) Error() string {
+	return string(c)
+}
+
+// RegistryError is one entry in the list of errors that a registry returns in the body of a response.
+type RegistryError struct {
+	Code    ErrorCode       `json:"code"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+	Message string          `json:"message"`
+}
+
+// ResponseError is returned if a registry responds with an unexpected status code.
+//
+// Use errors.Is() to check for a specific error code, e.g. errors.Is(err, ErrorCodeManifestUnknown).
+// errors.Is(err, ErrResourceNotFound) reports true if the status code is 404.
+type ResponseError struct {
+	// Errors contains the errors that the registry returned in the body of the response.
+	// It is empty if the body did not contain any errors, e.g. in response to a HEAD request.
+	Errors     []RegistryError
+	Method     string
+	StatusCode int
+	URL        string
+}
+
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("%s '%s' returned status code %d", e.Method, e.URL, e.StatusCode)
+	var details []string
+	for _, re := range e.Errors {
+		details = append(details, fmt.Sprintf("%s: %s", re.Code, re.Message))
+	}
+
+	if len(details) == 0 {
+		return msg
+	}
+
+	return msg + ": " + strings.Join(details, ", ")
+}
+
+// Is reports whether the response contains the ErrorCode target.
+// It also reports true if target is ErrResourceNotFound and the status code is 404.
+func (e *ResponseError) Is(target error) bool {
+	if target == ErrResourceNotFound {
+		return e.StatusCode == http.StatusNotFound
+	}
+
+	code, ok := target.(ErrorCode)
+	if !ok {
+		return false
+	}
+
+	for _, re := range e.Errors {
+		if re.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DigestMismatchError is returned if the digest of a manifest received from the registry does not match the requested digest
+// or the digest that the registry sent in the header Docker-Content-Digest.
+// errors.Is(err, ErrDigestMismatch) reports true for a DigestMismatchError.
+type DigestMismatchError struct {
+	// Actual is the digest computed from the content received from the registry.
+	Actual string
+	// Expected is the digest that the content should have.
+	Expected string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest of content '%s' does not match expected digest '%s'", e.Actual, e.Expected)
+}
+
+// Is reports whether target is ErrDigestMismatch.
+func (e *DigestMismatchError) Is(target error) bool {
+	return target == ErrDigestMismatch
+}
+
+type errorResponse struct {
+	Errors []RegistryError `json:"errors"`
+}
+
+// checkResponse returns a ResponseError if the status code of resp is none of expected.
+// It closes the body of resp in that case.
+func checkResponse(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	defer resp.Body.Close()
+	e := &ResponseError{StatusCode: resp.StatusCode}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.URL = resp.Request.URL.String()
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return e
+	}
+
+	// The body is not always JSON, e.g. if a proxy in front of the registry returns an error page.
+	er := errorResponse{}
+	if json.Unmarshal(data, &er) == nil {
+		e.Errors = er.Errors
+	}
+
+	return e
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseError(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"Tag":"test"}}]}`)
+	}))
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Images().GetByTag("test")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrResourceNotFound))
+	assert.True(t, errors.Is(err, ErrorCodeManifestUnknown))
+	assert.False(t, errors.Is(err, ErrorCodeDenied))
+
+	var respErr *ResponseError
+	require.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+	assert.Equal(t, "GET", respErr.Method)
+	require.Len(t, respErr.Errors, 1)
+	assert.Equal(t, "manifest unknown", respErr.Errors[0].Message)
+	assert.JSONEq(t, `{"Tag":"test"}`, string(respErr.Errors[0].Detail))
+}
+
+func TestResponseError_NoJSONBody(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `<html>Bad Gateway</html>`)
+	}))
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Tags().GetAll()
+	var respErr *ResponseError
+	require.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusBadGateway, respErr.StatusCode)
+	assert.Empty(t, respErr.Errors)
+	assert.False(t, errors.Is(err, ErrResourceNotFound))
+}
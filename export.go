@@ -0,0 +1,393 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ExportOptions configure how an image is exported.
+type ExportOptions struct {
+	// Platforms limits the export of a manifest list or an OCI image index to the manifests of these platforms.
+	// Platforms are matched like CopyOptions.Platforms. All platforms are exported if Platforms is empty.
+	// A docker archive can only contain one platform, so ExportDockerArchive() requires that exactly one platform matches.
+	Platforms []Platform
+}
+
+// dockerArchiveManifest is an entry in the file "manifest.json" of a docker archive.
+type dockerArchiveManifest struct {
+	Config   string
+	Layers   []string
+	RepoTags []string
+}
+
+// ExportOCILayout downloads an image, including all manifests, configs and layers, and writes it to dir in the OCI image layout.
+// See https://github.com/opencontainers/image-spec/blob/master/image-layout.md.
+// dir is created if it does not exist. An existing layout is extended. Blobs that it already contains are not downloaded again.
+// The image is added to "index.json" and annotated with the tag of the image.
+// Images with a manifest of schema v1 cannot be exported and return an error that wraps ErrSchemaV1NotSupported.
+func (i *ImageService) ExportOCILayout(img Image, dir string, opts ExportOptions) error {
+	return i.ExportOCILayoutContext(context.Background(), img, dir, opts)
+}
+
+// ExportOCILayoutContext writes an image to dir in the OCI image layout.
+// The context controls the lifetime of all requests.
+func (i *ImageService) ExportOCILayoutContext(ctx context.Context, img Image, dir string, opts ExportOptions) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, v1.ImageLayoutFile), layout, 0644)
+	if err != nil {
+		return errors.Wrap(err, "writing oci-layout")
+	}
+
+	desc, err := i.exportManifest(ctx, dir, exportRef(img), opts.Platforms, true)
+	if err != nil {
+		return errors.Wrapf(err, "exporting image '%s'", exportRef(img))
+	}
+
+	if img.Tag != "" {
+		desc.Annotations = map[string]string{v1.AnnotationRefName: img.Tag}
+	}
+
+	return addToOCIIndex(dir, desc)
+}
+
+// exportManifest writes the manifest identified by ref and everything it references to an OCI image layout.
+// The platforms of a manifest list are only filtered at the top level.
+func (i *ImageService) exportManifest(ctx context.Context, dir, ref string, platforms []Platform, filter bool) (v1.Descriptor, error) {
+	m, data, desc, err := i.getManifest(ctx, ref)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if _, ok := m.(*schema1.SignedManifest); ok {
+		// The manifest would be written with signatures or unsigned, which cannot be imported or pushed again.
+		return v1.Descriptor{}, errors.Wrapf(ErrSchemaV1NotSupported, "exporting manifest '%s'", ref)
+	}
+
+	mediaType := desc.MediaType
+	if list, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		var descriptors []manifestlist.ManifestDescriptor
+		for _, d := range list.Manifests {
+			if filter && !includesPlatform(platforms, d.Platform) {
+				continue
+			}
+
+			_, err := i.exportManifest(ctx, dir, d.Digest.String(), nil, false)
+			if err != nil {
+				return v1.Descriptor{}, err
+			}
+
+			descriptors = append(descriptors, d)
+		}
+
+		if len(descriptors) == 0 {
+			return v1.Descriptor{}, fmt.Errorf("manifest list '%s' does not contain any of the requested platforms", ref)
+		}
+
+		if len(descriptors) != len(list.Manifests) {
+			m, err = manifestlist.FromDescriptors(descriptors)
+			if err != nil {
+				return v1.Descriptor{}, errors.Wrap(err, "creating manifest list")
+			}
+
+			mediaType, data, err = m.Payload()
+			if err != nil {
+				return v1.Descriptor{}, errors.Wrap(err, "reading payload of manifest")
+			}
+		}
+	} else {
+		for _, d := range m.References() {
+			err := i.exportBlob(ctx, dir, d.Digest.String())
+			if err != nil {
+				return v1.Descriptor{}, err
+			}
+		}
+	}
+
+	dgst := digest.FromBytes(data)
+	err = writeFileAtomic(layoutBlobPath(dir, dgst), bytes.NewReader(data))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{Digest: dgst, MediaType: mediaType, Size: int64(len(data))}, nil
+}
+
+// exportBlob downloads a blob into an OCI image layout unless the layout already contains it.
+func (i *ImageService) exportBlob(ctx context.Context, dir, dgst string) error {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return errors.Wrapf(err, "parsing digest '%s'", dgst)
+	}
+
+	path := layoutBlobPath(dir, d)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	rc, err := i.repo.Blobs().OpenContext(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	return writeFileAtomic(path, rc)
+}
+
+// ExportDockerArchive downloads an image and writes it to w in the format of `docker save`, which `docker load` can read.
+// The archive is tagged with the tag of the image.
+// A docker archive contains one platform of an image. If the image is a manifest list, opts.Platforms needs to match exactly one platform.
+// The layers are written compressed, as stored in the registry.
+// Images with a manifest of schema v1 cannot be exported and return an error that wraps ErrSchemaV1NotSupported.
+func (i *ImageService) ExportDockerArchive(img Image, w io.Writer, opts ExportOptions) error {
+	return i.ExportDockerArchiveContext(context.Background(), img, w, opts)
+}
+
+// ExportDockerArchiveContext writes an image to w in the format of `docker save`.
+// The context controls the lifetime of all requests.
+func (i *ImageService) ExportDockerArchiveContext(ctx context.Context, img Image, w io.Writer, opts ExportOptions) error {
+	ref := exportRef(img)
+	m, _, _, err := i.getManifest(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	if list, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		var selected []manifestlist.ManifestDescriptor
+		for _, d := range list.Manifests {
+			if includesPlatform(opts.Platforms, d.Platform) {
+				selected = append(selected, d)
+			}
+		}
+
+		if len(selected) != 1 {
+			return fmt.Errorf("a docker archive contains exactly one platform but %d platforms of image '%s' match", len(selected), ref)
+		}
+
+		ref = selected[0].Digest.String()
+		m, _, _, err = i.getManifest(ctx, ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	var config []byte
+	var layers []distribution.Descriptor
+	switch manifest := m.(type) {
+	case *schema2.DeserializedManifest, *ocischema.DeserializedManifest:
+		config, err = i.readBlob(ctx, configDigest(manifest))
+		layers = manifest.References()[1:]
+	case *schema1.SignedManifest:
+		// `docker load` requires the digests of the uncompressed layers in the config, which manifests of schema v1 do not contain.
+		return errors.Wrapf(ErrSchemaV1NotSupported, "exporting image '%s' as docker archive", ref)
+	default:
+		return ErrSchemaUnknown
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "reading config of image '%s'", ref)
+	}
+
+	tw := tar.NewWriter(w)
+	entry := dockerArchiveManifest{Config: digest.FromBytes(config).Hex() + ".json", Layers: []string{}, RepoTags: []string{}}
+	err = writeTarFile(tw, entry.Config, bytes.NewReader(config), int64(len(config)))
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, l := range layers {
+		name := l.Digest.Hex() + "/layer.tar"
+		entry.Layers = append(entry.Layers, name)
+		if written[name] {
+			continue
+		}
+
+		err = i.writeLayer(ctx, tw, name, l)
+		if err != nil {
+			return err
+		}
+
+		written[name] = true
+	}
+
+	repositories := map[string]map[string]string{}
+	if img.Tag != "" {
+		named, err := reference.ParseNormalizedNamed(img.Domain + "/" + img.Repository)
+		if err != nil {
+			return errors.Wrap(err, "parsing name of image")
+		}
+
+		tagged, err := reference.WithTag(named, img.Tag)
+		if err != nil {
+			return errors.Wrap(err, "parsing tag of image")
+		}
+
+		entry.RepoTags = append(entry.RepoTags, reference.FamiliarString(tagged))
+		if len(layers) > 0 {
+			repositories[reference.FamiliarName(named)] = map[string]string{img.Tag: layers[len(layers)-1].Digest.Hex()}
+		}
+	}
+
+	err = writeTarJSON(tw, "manifest.json", []dockerArchiveManifest{entry})
+	if err != nil {
+		return err
+	}
+
+	err = writeTarJSON(tw, "repositories", repositories)
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeLayer downloads a layer and writes it to a tar archive.
+func (i *ImageService) writeLayer(ctx context.Context, tw *tar.Writer, name string, l distribution.Descriptor) error {
+	rc, err := i.repo.Blobs().OpenContext(ctx, l.Digest.String())
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	return writeTarFile(tw, name, rc, l.Size)
+}
+
+// exportRef returns the reference that identifies img in its repository.
+func exportRef(img Image) string {
+	if img.Digest != "" {
+		return img.Digest
+	}
+
+	return img.Tag
+}
+
+// addToOCIIndex adds desc to the file "index.json" of an OCI image layout.
+// An existing entry with the same reference name is replaced.
+func addToOCIIndex(dir string, desc v1.Descriptor) error {
+	path := filepath.Join(dir, "index.json")
+	index := v1.Index{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading index.json")
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return errors.Wrap(err, "unmarshalling index.json")
+		}
+	}
+
+	manifests := []v1.Descriptor{}
+	for _, m := range index.Manifests {
+		if desc.Annotations[v1.AnnotationRefName] != "" && m.Annotations[v1.AnnotationRefName] == desc.Annotations[v1.AnnotationRefName] {
+			continue
+		}
+
+		manifests = append(manifests, m)
+	}
+
+	index.SchemaVersion = 2
+	index.Manifests = append(manifests, desc)
+	data, err = json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, bytes.NewReader(data))
+}
+
+// layoutBlobPath returns the path of a blob in an OCI image layout.
+func layoutBlobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+// writeFileAtomic writes the content of r to a temporary file and renames it to path once all content has been written.
+// An incomplete file is never visible at path, e.g. if a download fails.
+func writeFileAtomic(path string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "writing '%s'", path)
+	}
+
+	return nil
+}
+
+func writeTarJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return writeTarFile(tw, name, bytes.NewReader(data), int64(len(data)))
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		ModTime:  time.Unix(0, 0),
+		Mode:     0644,
+		Name:     name,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "writing header of '%s'", name)
+	}
+
+	_, err = io.Copy(tw, r)
+	if err != nil {
+		return errors.Wrapf(err, "writing '%s'", name)
+	}
+
+	return nil
+}
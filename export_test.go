@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageService_ExportOCILayout(t *testing.T) {
+	mem := newMemoryRegistry()
+	mem.addTestIndex("e2e", "latest")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+	dir, err := ioutil.TempDir("", "oci-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	images := reg.Repository("e2e").Images()
+	img, err := images.GetByTag("latest")
+	require.NoError(t, err)
+	require.NoError(t, images.ExportOCILayout(img, dir, ExportOptions{Platforms: []Platform{{Architecture: "arm64", OS: "linux"}}}))
+
+	layout, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(layout))
+
+	var index v1.Index
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, "latest", index.Manifests[0].Annotations[v1.AnnotationRefName])
+	assert.NotEqual(t, img.Digest, index.Manifests[0].Digest.String())
+
+	// One manifest list, one manifest, one config and one layer.
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	require.NoError(t, err)
+	assert.Len(t, blobs, 4)
+	for _, b := range blobs {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", b.Name()))
+		require.NoError(t, err)
+		assert.Equal(t, b.Name(), digest.FromBytes(content).Hex())
+	}
+
+	// Exporting all platforms with the same tag replaces the entry in the index.
+	require.NoError(t, images.ExportOCILayout(img, dir, ExportOptions{}))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, img.Digest, index.Manifests[0].Digest.String())
+}
+
+func TestImageService_ExportDockerArchive(t *testing.T) {
+	mem := newMemoryRegistry()
+	mem.addTestIndex("team/app", "v1")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	images := reg.Repository("team/app").Images()
+	img, err := images.GetByTag("v1")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = images.ExportDockerArchive(img, buf, ExportOptions{})
+	assert.Error(t, err, "docker archive cannot contain multiple platforms")
+
+	buf.Reset()
+	require.NoError(t, images.ExportDockerArchive(img, buf, ExportOptions{Platforms: []Platform{{Architecture: "amd64", OS: "linux"}}}))
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		files[h.Name], err = ioutil.ReadAll(tr)
+		require.NoError(t, err)
+	}
+
+	var manifests []dockerArchiveManifest
+	require.NoError(t, json.Unmarshal(files["manifest.json"], &manifests))
+	require.Len(t, manifests, 1)
+	assert.Equal(t, []string{img.Domain + "/team/app:v1"}, manifests[0].RepoTags)
+	assert.JSONEq(t, `{"architecture":"amd64","os":"linux"}`, string(files[manifests[0].Config]))
+	require.Len(t, manifests[0].Layers, 1)
+	assert.Equal(t, []byte("layer of amd64"), files[manifests[0].Layers[0]])
+	assert.Contains(t, string(files["repositories"]), img.Domain+"/team/app")
+}
+
+func TestImageService_ExportDockerArchive_Schema1(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, schema1Handler(t, newTestSchema1Manifest(t)))
+	defer closeFunc()
+
+	images := reg.Repository("e2e").Images()
+	img, err := images.GetByTag("old")
+	require.NoError(t, err)
+
+	err = images.ExportDockerArchive(img, &bytes.Buffer{}, ExportOptions{})
+	assert.True(t, errors.Is(err, ErrSchemaV1NotSupported))
+}
+
+func TestImageService_ExportOCILayout_Schema1(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, unsignedSchema1Handler(newTestSchema1Manifest(t), schema1.MediaTypeManifest))
+	defer closeFunc()
+
+	images := reg.Repository("e2e").Images()
+	img, err := images.GetByTag("old")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "registry-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = images.ExportOCILayout(img, dir, ExportOptions{})
+	assert.True(t, errors.Is(err, ErrSchemaV1NotSupported))
+}
@@ -0,0 +1,8 @@
+Feature: Blobs
+
+   Scenario: Read config blob
+    Given a running Docker registry at "127.0.0.1:6363"
+    And a Docker image "127.0.0.1:6363/e2e:test" built from "Dockerfile"
+    And a Docker image "127.0.0.1:6363/e2e:test" pushed
+    When reading the config blob of "127.0.0.1:6363/e2e:test"
+    Then the blob contains "rootfs"
@@ -1,9 +1,108 @@
 package registry
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestImageService_GetByTag_OCIIndex(t *testing.T) {
+	index := `{
+		"schemaVersion": 2,
+		"manifests": [{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			"size": 527,
+			"platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}
+		}]
+	}`
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest.FromString(index).String())
+		fmt.Fprint(w, index)
+	}))
+	defer closeFunc()
+
+	img, err := reg.Repository("e2e").Images().GetByTag("test")
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString(index).String(), img.Digest)
+	require.Len(t, img.Platforms, 1)
+	assert.Equal(t, "arm64", img.Platforms[0].Architecture)
+	assert.Equal(t, "v8", img.Platforms[0].Variant)
+	assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", img.Platforms[0].MediaType)
+	assert.Equal(t, 527, img.Platforms[0].Size)
+}
+
+func TestImageService_GetByTag_PlatformFromConfig(t *testing.T) {
+	config := `{"architecture":"amd64","os":"windows","os.version":"10.0.17763.1457","os.features":["win32k"]}`
+	manifest := fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "digest": "%s", "size": %d},
+		"layers": []
+	}`, digest.FromString(config), len(config))
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/e2e/manifests/test":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Header().Set("Docker-Content-Digest", digest.FromString(manifest).String())
+			fmt.Fprint(w, manifest)
+		case "/v2/e2e/blobs/" + digest.FromString(config).String():
+			fmt.Fprint(w, config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer closeFunc()
+
+	img, err := reg.Repository("e2e").Images().GetByTag("test")
+	require.NoError(t, err)
+	require.Len(t, img.Platforms, 1)
+	p := img.Platforms[0]
+	assert.Equal(t, "amd64", p.Architecture)
+	assert.Equal(t, "windows", p.OS)
+	assert.Equal(t, "10.0.17763.1457", p.OSVersion)
+	assert.Equal(t, []string{"win32k"}, p.OSFeatures)
+	assert.Equal(t, digest.FromString(manifest).String(), p.Digest)
+	assert.Equal(t, len(manifest), p.Size)
+}
+
+func TestImageService_GetByTag_ConfigDigestMismatch(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/e2e/manifests/test" {
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprintf(w, `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"digest":"%s"},"layers":[]}`, digest.FromString("{}"))
+			return
+		}
+
+		fmt.Fprint(w, `{"architecture":"arm64","os":"linux"}`)
+	}))
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Images().GetByTag("test")
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+}
+
+func TestImageService_GetByTagContext_Canceled(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not have been sent")
+	}))
+	defer closeFunc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := reg.Repository("e2e").Images().GetByTagContext(ctx, "test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+}
+
 var (
 	theImageHasTheDigestResult string
 )
@@ -75,9 +174,58 @@ func theImageDoesNotExist(imageName string) error {
 		return fmt.Errorf("Expected image %s to not exist but it does", imageName)
 	}
 
-	if err != ErrResourceNotFound {
+	if !errors.Is(err, ErrResourceNotFound) {
 		return fmt.Errorf("Expected error ErrResourceNotFound to be returned but got: %s", err)
 	}
 
 	return nil
 }
+
+func TestImageService_Resolve(t *testing.T) {
+	mem := newMemoryRegistry()
+	dgst := mem.addTestIndex("e2e", "latest")
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/e2e/manifests/latest" {
+			assert.Equal(t, "HEAD", r.Method)
+			assert.Equal(t, manifestAcceptHeader, r.Header.Get("Accept"))
+		}
+
+		mem.ServeHTTP(w, r)
+	}))
+	defer closeFunc()
+
+	desc, err := reg.Repository("e2e").Images().Resolve("latest")
+	require.NoError(t, err)
+	assert.Equal(t, dgst, desc.Digest)
+	assert.Equal(t, "application/vnd.docker.distribution.manifest.list.v2+json", desc.MediaType)
+	assert.Equal(t, int64(len(mem.manifests["e2e:latest"].data)), desc.Size)
+}
+
+func TestImageService_Resolve_WithoutDigestHeader(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	methods := []string{}
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest)))
+		if r.Method == "GET" {
+			fmt.Fprint(w, manifest)
+		}
+	}))
+	defer closeFunc()
+
+	desc, err := reg.Repository("e2e").Images().Resolve("latest")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"HEAD", "GET"}, methods)
+	assert.Equal(t, digest.FromString(manifest).String(), desc.Digest)
+	assert.Equal(t, "application/vnd.oci.image.index.v1+json", desc.MediaType)
+	assert.Equal(t, int64(len(manifest)), desc.Size)
+}
+
+func TestImageService_Resolve_NotFound(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, newMemoryRegistry())
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Images().Resolve("latest")
+	assert.True(t, errors.Is(err, ErrResourceNotFound))
+}
@@ -0,0 +1,353 @@
+package registry
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ImportOCILayout reads an image from the OCI image layout in dir and uploads it to the repository with tag.
+// See https://github.com/opencontainers/image-spec/blob/master/image-layout.md.
+// The image in "index.json" that is annotated with tag is uploaded.
+// If no image is annotated with tag, "index.json" needs to contain exactly one image.
+// Blobs that already exist in the repository are skipped. Manifests are uploaded unchanged, so their digests are preserved.
+// It returns the digest of the uploaded image.
+func (i *ImageService) ImportOCILayout(dir, tag string) (string, error) {
+	return i.ImportOCILayoutContext(context.Background(), dir, tag)
+}
+
+// ImportOCILayoutContext reads an image from the OCI image layout in dir and uploads it to the repository with tag.
+// The context controls the lifetime of all requests.
+func (i *ImageService) ImportOCILayoutContext(ctx context.Context, dir, tag string) (string, error) {
+	var index v1.Index
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return "", errors.Wrap(err, "reading index.json")
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshalling index.json")
+	}
+
+	var selected []v1.Descriptor
+	for _, d := range index.Manifests {
+		if d.Annotations[v1.AnnotationRefName] == tag {
+			selected = append(selected, d)
+		}
+	}
+
+	if len(selected) == 0 {
+		selected = index.Manifests
+	}
+
+	if len(selected) != 1 {
+		return "", fmt.Errorf("index.json in '%s' contains %d images and none of them is annotated with tag '%s'", dir, len(selected), tag)
+	}
+
+	return i.importOCIManifest(ctx, dir, selected[0], tag)
+}
+
+// importOCIManifest uploads a manifest of an OCI image layout and everything it references.
+// The manifest is uploaded with tag or, if tag is empty, with its digest.
+func (i *ImageService) importOCIManifest(ctx context.Context, dir string, desc v1.Descriptor, tag string) (string, error) {
+	data, err := readLayoutBlob(dir, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	m, _, err := distribution.UnmarshalManifest(desc.MediaType, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "unmarshalling manifest '%s'", desc.Digest)
+	}
+
+	if list, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		for _, d := range list.Manifests {
+			_, err := i.importOCIManifest(ctx, dir, v1.Descriptor{Digest: d.Digest, MediaType: d.MediaType, Size: d.Size}, "")
+			if err != nil {
+				return "", err
+			}
+		}
+	} else {
+		for _, d := range m.References() {
+			blob := layoutBlobPath(dir, d.Digest)
+			err := i.pushBlob(ctx, d.Digest.String(), d.Size, func() (io.ReadCloser, error) {
+				return os.Open(blob)
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if tag == "" {
+		tag = desc.Digest.String()
+	}
+
+	return i.repo.Manifests().PutContext(ctx, tag, m)
+}
+
+// readLayoutBlob reads a blob of an OCI image layout and verifies it against its digest.
+func readLayoutBlob(dir string, dgst digest.Digest) ([]byte, error) {
+	data, err := ioutil.ReadFile(layoutBlobPath(dir, dgst))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading blob '%s'", dgst)
+	}
+
+	if digest.FromBytes(data) != dgst {
+		return nil, errors.Wrapf(ErrDigestMismatch, "reading blob '%s'", dgst)
+	}
+
+	return data, nil
+}
+
+// ImportDockerArchive reads an image from a docker archive, as written by `docker save`, and uploads it to the repository with tag.
+// The archive can contain compressed or uncompressed layers. Uncompressed layers are compressed with gzip before they are uploaded.
+// A manifest of schema v2 is created for the image.
+// If the archive contains multiple images, e.g. written by `docker save a b`, the image with tag in its RepoTags is uploaded.
+// Blobs that already exist in the repository are skipped.
+// It returns the digest of the uploaded image.
+func (i *ImageService) ImportDockerArchive(archive, tag string) (string, error) {
+	return i.ImportDockerArchiveContext(context.Background(), archive, tag)
+}
+
+// ImportDockerArchiveContext reads an image from a docker archive and uploads it to the repository with tag.
+// The context controls the lifetime of all requests.
+func (i *ImageService) ImportDockerArchiveContext(ctx context.Context, archive, tag string) (string, error) {
+	// The files in the archive can be in any order, so the archive is read twice:
+	// once to read manifest.json, once to read the configs and upload the layers.
+	var entries []dockerArchiveManifest
+	err := walkTar(archive, func(name string, r io.Reader) error {
+		if name != "manifest.json" {
+			return nil
+		}
+
+		return errors.Wrap(json.NewDecoder(r).Decode(&entries), "reading manifest.json")
+	})
+	if err != nil {
+		return "", err
+	}
+
+	e, err := selectDockerArchiveImage(entries, tag)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading docker archive '%s'", archive)
+	}
+
+	configs := map[string][]byte{path.Clean(e.Config): nil}
+	layers := map[string]distribution.Descriptor{}
+	for _, l := range e.Layers {
+		layers[path.Clean(l)] = distribution.Descriptor{}
+	}
+
+	err = walkTar(archive, func(name string, r io.Reader) error {
+		if _, ok := configs[name]; ok {
+			data, err := ioutil.ReadAll(r)
+			configs[name] = data
+			return errors.Wrapf(err, "reading config '%s'", name)
+		}
+
+		if _, ok := layers[name]; !ok {
+			return nil
+		}
+
+		desc, err := i.importLayer(ctx, r)
+		if err != nil {
+			return errors.Wrapf(err, "uploading layer '%s'", name)
+		}
+
+		layers[name] = desc
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return i.importDockerArchiveImage(ctx, e, configs, layers, tag)
+}
+
+// selectDockerArchiveImage returns the entry of manifest.json that has tag in its RepoTags.
+// The only entry is returned if manifest.json contains one entry.
+func selectDockerArchiveImage(entries []dockerArchiveManifest, tag string) (dockerArchiveManifest, error) {
+	if len(entries) == 1 {
+		return entries[0], nil
+	}
+
+	var selected []dockerArchiveManifest
+	for _, e := range entries {
+		for _, rt := range e.RepoTags {
+			named, err := reference.ParseNormalizedNamed(rt)
+			if err != nil {
+				continue
+			}
+
+			if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() == tag {
+				selected = append(selected, e)
+				break
+			}
+		}
+	}
+
+	if len(selected) != 1 {
+		return dockerArchiveManifest{}, fmt.Errorf("manifest.json contains %d images and %d of them have tag '%s'", len(entries), len(selected), tag)
+	}
+
+	return selected[0], nil
+}
+
+// importDockerArchiveImage uploads the config of an image in a docker archive and creates its manifest.
+// The manifest is uploaded with tag.
+func (i *ImageService) importDockerArchiveImage(ctx context.Context, e dockerArchiveManifest, configs map[string][]byte, layers map[string]distribution.Descriptor, tag string) (string, error) {
+	config := configs[path.Clean(e.Config)]
+	if config == nil {
+		return "", fmt.Errorf("docker archive does not contain config '%s'", e.Config)
+	}
+
+	configDigest := digest.FromBytes(config)
+	err := i.pushBlob(ctx, configDigest.String(), int64(len(config)), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(config)), nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "uploading config '%s'", e.Config)
+	}
+
+	m := schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{Digest: configDigest, MediaType: schema2.MediaTypeImageConfig, Size: int64(len(config))},
+		Layers:    []distribution.Descriptor{},
+	}
+	for _, l := range e.Layers {
+		layer := layers[path.Clean(l)]
+		if layer.Digest == "" {
+			return "", fmt.Errorf("docker archive does not contain layer '%s'", l)
+		}
+
+		m.Layers = append(m.Layers, layer)
+	}
+
+	dm, err := schema2.FromStruct(m)
+	if err != nil {
+		return "", errors.Wrap(err, "creating manifest")
+	}
+
+	return i.repo.Manifests().PutContext(ctx, tag, dm)
+}
+
+// importLayer uploads a layer of a docker archive. Uncompressed layers are compressed with gzip.
+// The layer is written to a temporary file first because its digest needs to be known to check if the repository already contains it.
+func (i *ImageService) importLayer(ctx context.Context, r io.Reader) (distribution.Descriptor, error) {
+	var desc distribution.Descriptor
+	f, err := ioutil.TempFile("", "registry-layer-")
+	if err != nil {
+		return desc, err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+	digester := digest.Canonical.Digester()
+	w := io.MultiWriter(f, digester.Hash())
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		desc.Size, err = io.Copy(w, br)
+	} else {
+		cw := &countingWriter{w: w}
+		gw := gzip.NewWriter(cw)
+		_, err = io.Copy(gw, br)
+		if err == nil {
+			err = gw.Close()
+		}
+
+		desc.Size = cw.n
+	}
+
+	if err != nil {
+		return desc, err
+	}
+
+	desc.Digest = digester.Digest()
+	desc.MediaType = schema2.MediaTypeLayer
+	err = i.pushBlob(ctx, desc.Digest.String(), desc.Size, func() (io.ReadCloser, error) {
+		_, err := f.Seek(0, io.SeekStart)
+		return ioutil.NopCloser(f), err
+	})
+	return desc, err
+}
+
+// pushBlob uploads a blob unless the repository already contains it.
+func (i *ImageService) pushBlob(ctx context.Context, dgst string, size int64, open func() (io.ReadCloser, error)) error {
+	_, err := i.repo.Blobs().StatContext(ctx, dgst)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, ErrResourceNotFound) {
+		return err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	_, err = i.repo.Blobs().UploadContext(ctx, rc, size, dgst)
+	return err
+}
+
+// walkTar calls fn for each regular file in a tar archive.
+func walkTar(archive string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "reading '%s'", archive)
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = fn(path.Clean(h.Name), tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type countingWriter struct {
+	n int64
+	w io.Writer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestArchive(t *testing.T, files map[string][]byte, order []string) string {
+	f, err := ioutil.TempFile("", "docker-archive")
+	require.NoError(t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, name := range order {
+		require.NoError(t, writeTarFile(tw, name, bytes.NewReader(files[name]), int64(len(files[name]))))
+	}
+
+	require.NoError(t, tw.Close())
+	return f.Name()
+}
+
+func TestImageService_ImportOCILayout(t *testing.T) {
+	srcMem := newMemoryRegistry()
+	srcDigest := srcMem.addTestIndex("src", "latest")
+	srcReg, closeSrc := newTestRegistry(t, srcMem)
+	defer closeSrc()
+	dstMem := newMemoryRegistry()
+	dstReg, closeDst := newTestRegistry(t, dstMem)
+	defer closeDst()
+	dir, err := ioutil.TempDir("", "oci-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	img, err := srcReg.Repository("src").Images().GetByTag("latest")
+	require.NoError(t, err)
+	require.NoError(t, srcReg.Repository("src").Images().ExportOCILayout(img, dir, ExportOptions{}))
+
+	dgst, err := dstReg.Repository("dst").Images().ImportOCILayout(dir, "latest")
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest, dgst)
+	assert.Equal(t, srcMem.manifests["src:latest"], dstMem.manifests["dst:latest"])
+	assert.Len(t, dstMem.blobs, 4)
+}
+
+func TestImageService_ImportDockerArchive(t *testing.T) {
+	mem := newMemoryRegistry()
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	layer := &bytes.Buffer{}
+	tw := tar.NewWriter(layer)
+	require.NoError(t, writeTarFile(tw, "hello.txt", bytes.NewReader([]byte("hello")), 5))
+	require.NoError(t, tw.Close())
+	files := map[string][]byte{
+		"abc/layer.tar": layer.Bytes(),
+		"config.json":   []byte(`{"architecture":"arm64","os":"linux","variant":"v8"}`),
+		"manifest.json": []byte(`[{"Config":"config.json","RepoTags":["app:v1"],"Layers":["abc/layer.tar"]}]`),
+	}
+	archive := writeTestArchive(t, files, []string{"manifest.json", "abc/layer.tar", "config.json"})
+	defer os.Remove(archive)
+
+	dgst, err := reg.Repository("app").Images().ImportDockerArchive(archive, "v1")
+	require.NoError(t, err)
+
+	var m schema2.Manifest
+	require.NoError(t, json.Unmarshal(mem.manifests["app:v1"].data, &m))
+	assert.Equal(t, schema2.MediaTypeManifest, mem.manifests["app@"+dgst].mediaType)
+	assert.Equal(t, files["config.json"], mem.blobs["app@"+m.Config.Digest.String()])
+	require.Len(t, m.Layers, 1)
+	compressed := mem.blobs["app@"+m.Layers[0].Digest.String()]
+	assert.Equal(t, []byte{0x1f, 0x8b}, compressed[:2])
+	assert.Equal(t, int64(len(compressed)), m.Layers[0].Size)
+
+	img, err := reg.Repository("app").Images().GetByTag("v1")
+	require.NoError(t, err)
+	require.Len(t, img.Platforms, 1)
+	assert.Equal(t, "arm64", img.Platforms[0].Architecture)
+}
+
+func TestImageService_ImportDockerArchive_Exported(t *testing.T) {
+	srcMem := newMemoryRegistry()
+	srcMem.addTestIndex("src", "latest")
+	srcReg, closeSrc := newTestRegistry(t, srcMem)
+	defer closeSrc()
+	dstMem := newMemoryRegistry()
+	dstReg, closeDst := newTestRegistry(t, dstMem)
+	defer closeDst()
+	f, err := ioutil.TempFile("", "docker-archive")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	img, err := srcReg.Repository("src").Images().GetByTag("latest")
+	require.NoError(t, err)
+	require.NoError(t, srcReg.Repository("src").Images().ExportDockerArchive(img, f, ExportOptions{Platforms: []Platform{{Architecture: "amd64", OS: "linux"}}}))
+	require.NoError(t, f.Close())
+
+	_, err = dstReg.Repository("dst").Images().ImportDockerArchive(f.Name(), "latest")
+	require.NoError(t, err)
+
+	var m schema2.Manifest
+	require.NoError(t, json.Unmarshal(dstMem.manifests["dst:latest"].data, &m))
+	assert.Equal(t, srcMem.blobs["src@"+m.Config.Digest.String()], dstMem.blobs["dst@"+m.Config.Digest.String()])
+	require.Len(t, m.Layers, 1)
+	assert.Len(t, dstMem.blobs, 2)
+}
+
+func TestImageService_ImportDockerArchive_MultipleImages(t *testing.T) {
+	mem := newMemoryRegistry()
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	files := map[string][]byte{
+		"layer.tar.gz":  {0x1f, 0x8b, 0x08, 0x00},
+		"amd64.json":    []byte(`{"architecture":"amd64","os":"linux"}`),
+		"arm64.json":    []byte(`{"architecture":"arm64","os":"linux"}`),
+		"manifest.json": []byte(`[{"Config":"amd64.json","RepoTags":["app:v1"],"Layers":["layer.tar.gz"]},{"Config":"arm64.json","RepoTags":["example.com/other:v2"],"Layers":["layer.tar.gz"]}]`),
+	}
+	archive := writeTestArchive(t, files, []string{"layer.tar.gz", "amd64.json", "arm64.json", "manifest.json"})
+	defer os.Remove(archive)
+
+	_, err := reg.Repository("app").Images().ImportDockerArchive(archive, "v2")
+	require.NoError(t, err)
+	assert.Equal(t, schema2.MediaTypeManifest, mem.manifests["app:v2"].mediaType)
+
+	img, err := reg.Repository("app").Images().GetByTag("v2")
+	require.NoError(t, err)
+	require.Len(t, img.Platforms, 1)
+	assert.Equal(t, "arm64", img.Platforms[0].Architecture)
+
+	_, err = reg.Repository("app").Images().ImportDockerArchive(archive, "v3")
+	assert.Error(t, err)
+}
+
+func TestImageService_ImportDockerArchive_TokenAuth(t *testing.T) {
+	mem := newMemoryRegistry()
+	reg, closeFunc := newTokenTestRegistry(t, mem)
+	defer closeFunc()
+
+	files := map[string][]byte{
+		"layer.tar":     []byte("uncompressed layer"),
+		"config.json":   []byte(`{"architecture":"amd64","os":"linux"}`),
+		"manifest.json": []byte(`[{"Config":"config.json","Layers":["layer.tar"]}]`),
+	}
+	archive := writeTestArchive(t, files, []string{"manifest.json", "layer.tar", "config.json"})
+	defer os.Remove(archive)
+
+	_, err := reg.Repository("app").Images().ImportDockerArchive(archive, "v1")
+	require.NoError(t, err)
+	assert.Len(t, mem.blobs, 2)
+}
+
+func TestImageService_ImportOCILayout_Ambiguous(t *testing.T) {
+	mem := newMemoryRegistry()
+	mem.addTestImage("src", "amd64", "amd64")
+	mem.addTestImage("src", "arm64", "arm64")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+	dir, err := ioutil.TempDir("", "oci-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	images := reg.Repository("src").Images()
+	for _, tag := range []string{"amd64", "arm64"} {
+		img, err := images.GetByTag(tag)
+		require.NoError(t, err)
+		require.NoError(t, images.ExportOCILayout(img, dir, ExportOptions{}))
+	}
+
+	_, err = reg.Repository("dst").Images().ImportOCILayout(dir, "latest")
+	assert.Error(t, err)
+
+	dgst, err := reg.Repository("dst").Images().ImportOCILayout(dir, "arm64")
+	require.NoError(t, err)
+	assert.Equal(t, mem.manifests["src:arm64"], mem.manifests["dst@"+dgst])
+}
+
+func TestImageService_ImportOCILayout_Missing(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, newMemoryRegistry())
+	defer closeFunc()
+
+	_, err := reg.Repository("app").Images().ImportOCILayout(filepath.Join(os.TempDir(), "does-not-exist"), "v1")
+	assert.Error(t, err)
+}
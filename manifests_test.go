@@ -2,14 +2,133 @@ package registry
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
 	gettingTheManifestOfForPlatformWithOsAndArchResult schema2.Manifest
 )
 
+func TestManifestService_GetOCI(t *testing.T) {
+	manifest := `{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111", "size": 100},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222", "size": 200}]
+	}`
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		fmt.Fprint(w, manifest)
+	}))
+	defer closeFunc()
+
+	m, err := reg.Repository("e2e").Manifests().GetOCI(digest.FromString(manifest).String())
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.oci.image.config.v1+json", m.Config.MediaType)
+	require.Len(t, m.Layers, 1)
+	assert.Equal(t, int64(200), m.Layers[0].Size)
+}
+
+func TestManifestService_GetRaw(t *testing.T) {
+	mem := newMemoryRegistry()
+	dgst := mem.addTestIndex("e2e", "latest")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	data, desc, err := reg.Repository("e2e").Manifests().GetRaw("latest")
+	require.NoError(t, err)
+	assert.Equal(t, mem.manifests["e2e:latest"].data, data)
+	assert.Equal(t, Descriptor{Digest: dgst, MediaType: manifestlist.MediaTypeManifestList, Size: int64(len(data))}, desc)
+}
+
+func TestManifestService_GetRaw_DigestMismatch(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	header := ""
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", header)
+		fmt.Fprint(w, manifest)
+	}))
+	defer closeFunc()
+
+	_, _, err := reg.Repository("e2e").Manifests().GetRaw("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	assert.True(t, errors.Is(err, ErrDigestMismatch))
+	var mismatch *DigestMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	assert.Equal(t, digest.FromString(manifest).String(), mismatch.Actual)
+	assert.Equal(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111", mismatch.Expected)
+
+	header = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	_, _, err = reg.Repository("e2e").Manifests().GetRaw("latest")
+	assert.True(t, errors.Is(err, ErrDigestMismatch))
+
+	_, err = reg.Repository("e2e").Images().GetByTag("latest")
+	assert.True(t, errors.Is(err, ErrDigestMismatch))
+
+	header = digest.FromString(manifest).String()
+	_, desc, err := reg.Repository("e2e").Manifests().GetRaw(header)
+	require.NoError(t, err)
+	assert.Equal(t, header, desc.Digest)
+}
+
+func TestManifestService_Put(t *testing.T) {
+	m, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{
+		Descriptor: distribution.Descriptor{
+			Digest:    "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			MediaType: schema2.MediaTypeManifest,
+			Size:      100,
+		},
+		Platform: manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+	}})
+	require.NoError(t, err)
+	_, payload, err := m.Payload()
+	require.NoError(t, err)
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "/v2/e2e/manifests/latest", r.URL.Path)
+		assert.Equal(t, manifestlist.MediaTypeManifestList, r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, payload, body)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(body).String())
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer closeFunc()
+
+	dgst, err := reg.Repository("e2e").Manifests().Put("latest", m)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(payload).String(), dgst)
+}
+
+func TestManifestService_Put_DigestMismatch(t *testing.T) {
+	m, err := manifestlist.FromDescriptors(nil)
+	require.NoError(t, err)
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:1111111111111111111111111111111111111111111111111111111111111111")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer closeFunc()
+
+	_, err = reg.Repository("e2e").Manifests().Put("latest", m)
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+
+	_, err = reg.Repository("e2e").Manifests().Put("sha256:2222222222222222222222222222222222222222222222222222222222222222", m)
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+}
+
 func gettingTheManifestOfForPlatformWithOsAndArch(imageName, os, arch string) error {
 	domain, path, tag, _, err := ParseImageName(imageName)
 	if err != nil {
@@ -49,3 +168,21 @@ func theManifestHasTheMediaType(mediaType string) error {
 
 	return nil
 }
+
+func TestManifestService_Put_Schema1(t *testing.T) {
+	var requests int
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Manifests().Put("old", newTestSchema1Manifest(t))
+	assert.True(t, errors.Is(err, ErrSchemaV1NotSupported))
+
+	unsigned, err := unmarshalSchema1(newTestSchema1Manifest(t).Canonical)
+	require.NoError(t, err)
+	_, err = reg.Repository("e2e").Manifests().Put("old", unsigned)
+	assert.True(t, errors.Is(err, ErrSchemaV1NotSupported))
+	assert.Equal(t, 0, requests)
+}
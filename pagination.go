@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListOptions configure a paginated listing.
+// See https://docs.docker.com/registry/spec/api/#pagination.
+type ListOptions struct {
+	// Last starts the listing after this entry.
+	// Pass the value returned by TagIterator.Tag() or CatalogIterator.Last() to resume a listing.
+	Last string
+	// PageSize is the number of entries to request per page. The registry can return less entries.
+	// Defaults to the page size of the registry.
+	PageSize int
+}
+
+// pager requests the pages of a paginated listing.
+type pager struct {
+	ctx  context.Context
+	done bool
+	// next is the URL of the next page as returned by the registry in the Link header.
+	next string
+	opts ListOptions
+	path string
+	r    *Requester
+}
+
+// fetch requests the next page and decodes it into out.
+// It sets done if the registry did not link to another page.
+func (p *pager) fetch(out interface{}) error {
+	var req *http.Request
+	var err error
+	if p.next == "" {
+		q := url.Values{}
+		if p.opts.Last != "" {
+			q.Set("last", p.opts.Last)
+		}
+
+		if p.opts.PageSize > 0 {
+			q.Set("n", strconv.Itoa(p.opts.PageSize))
+		}
+
+		path := p.path
+		if len(q) > 0 {
+			path += "?" + q.Encode()
+		}
+
+		req, err = p.r.NewRequestContext(p.ctx, "GET", path, nil)
+	} else {
+		req, err = p.r.newRequestURL(p.ctx, "GET", p.next, nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	headers, err := p.r.GetJSON(req, out)
+	if err != nil {
+		return err
+	}
+
+	next, ok := parseNextLink(headers.Get("Link"), req.URL)
+	if !ok {
+		p.done = true
+		return nil
+	}
+
+	// The request to the next page carries the credentials of the registry, so it must not leave the registry.
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host {
+		return fmt.Errorf("registry linked to the next page at '%s', which is not on the registry", next)
+	}
+
+	p.next = next
+	return nil
+}
+
+// nextCursor returns the value of the parameter "last" of the next page.
+// It returns fallback if the link to the next page does not contain the parameter.
+// It returns an empty string if there is no next page.
+func (p *pager) nextCursor(fallback string) string {
+	if p.done {
+		return ""
+	}
+
+	u, err := url.Parse(p.next)
+	if err != nil || u.Query().Get("last") == "" {
+		return fallback
+	}
+
+	return u.Query().Get("last")
+}
+
+// parseNextLink returns the URL of the next page from a Link header as described in https://tools.ietf.org/html/rfc5988.
+// Relative URLs are resolved against the URL of the request.
+func parseNextLink(h string, base *url.URL) (string, bool) {
+	for _, link := range strings.Split(h, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" || strings.Trim(kv[1], `"`) != "next" {
+				continue
+			}
+
+			u, err := base.Parse(strings.Trim(target, "<>"))
+			if err != nil {
+				return "", false
+			}
+
+			return u.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// listIterator iterates over the entries of a paginated listing.
+type listIterator struct {
+	// decode requests the next page and returns its entries.
+	decode func(p *pager) ([]string, error)
+	err    error
+	index  int
+	last   string
+	page   []string
+	pager  *pager
+}
+
+func (it *listIterator) next() bool {
+	for it.index >= len(it.page) {
+		if it.err != nil || it.pager.done {
+			return false
+		}
+
+		it.index = 0
+		it.page, it.err = it.decode(it.pager)
+		if it.err != nil {
+			return false
+		}
+	}
+
+	it.last = it.page[it.index]
+	it.index++
+	return true
+}
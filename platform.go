@@ -0,0 +1,318 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/pkg/errors"
+)
+
+// ErrNoMatchingPlatform indicates that an image does not contain a platform that matches the requested platform.
+var ErrNoMatchingPlatform = fmt.Errorf("image does not contain a matching platform")
+
+// defaultVariants are the variants assumed for architectures if a platform does not set a variant.
+var defaultVariants = map[string]string{
+	"arm":   "v7",
+	"arm64": "v8",
+}
+
+// firstVariants are the first variants of architectures that platforms commonly leave out.
+var firstVariants = map[string]string{
+	"amd64": "v1",
+}
+
+// variantFallbacks lists the variants of an architecture that can run on a variant, ordered from most to least preferred.
+var variantFallbacks = map[string][]string{
+	"amd64": {"v4", "v3", "v2", "v1"},
+	"arm":   {"v8", "v7", "v6", "v5"},
+}
+
+// ParsePlatform parses a platform in the format "os/arch[/variant]", e.g. "linux/arm64/v8".
+// The returned platform is normalized.
+func ParsePlatform(s string) (Platform, error) {
+	var p Platform
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return p, fmt.Errorf("platform '%s' is not in the format os/arch[/variant]", s)
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return p, fmt.Errorf("platform '%s' contains an empty component", s)
+		}
+	}
+
+	p.OS = parts[0]
+	p.Architecture = parts[1]
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return NormalizePlatform(p), nil
+}
+
+// NormalizePlatform returns a copy of p with the common spellings of operating systems, architectures and variants.
+// For example, the architecture "aarch64" becomes "arm64" and the variant "7" becomes "v7".
+// It sets the default variant of an architecture, e.g. "v8" for "arm64", if p does not set a variant.
+func NormalizePlatform(p Platform) Platform {
+	p.OS = strings.ToLower(p.OS)
+	if p.OS == "macos" {
+		p.OS = "darwin"
+	}
+
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+	switch p.Architecture {
+	case "i386", "i686", "x86":
+		p.Architecture = "386"
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture = "arm"
+		p.Variant = "v7"
+	case "armel":
+		p.Architecture = "arm"
+		p.Variant = "v6"
+	case "armv5l", "armv6l", "armv7l", "armv8l":
+		p.Variant = "v" + p.Architecture[4:5]
+		p.Architecture = "arm"
+	}
+
+	if _, err := strconv.Atoi(p.Variant); err == nil {
+		p.Variant = "v" + p.Variant
+	}
+
+	if p.Variant == "" {
+		p.Variant = defaultVariants[p.Architecture]
+	}
+
+	return p
+}
+
+// DefaultPlatform returns the platform of the running program as reported by runtime.GOOS and runtime.GOARCH.
+func DefaultPlatform() Platform {
+	return NormalizePlatform(Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS})
+}
+
+// PlatformMatcher selects the platforms of an image that can run on a wanted platform.
+//
+// A platform matches if its operating system and architecture are equal to the wanted platform
+// and its variant is the wanted variant or an older variant, e.g. "linux/arm/v6" matches "linux/arm/v7".
+// A Windows platform also needs the same major, minor and build version as the wanted platform if the wanted platform sets OSVersion.
+type PlatformMatcher struct {
+	want Platform
+}
+
+// NewPlatformMatcher returns a PlatformMatcher for want.
+// The operating system and the architecture of the running program are used if want does not set them.
+func NewPlatformMatcher(want Platform) *PlatformMatcher {
+	def := DefaultPlatform()
+	if want.OS == "" {
+		want.OS = def.OS
+	}
+
+	if want.Architecture == "" {
+		want.Architecture = def.Architecture
+		if want.Variant == "" {
+			want.Variant = def.Variant
+		}
+	}
+
+	return &PlatformMatcher{want: NormalizePlatform(want)}
+}
+
+// Match reports whether p can run on the wanted platform.
+func (m *PlatformMatcher) Match(p Platform) bool {
+	return m.rank(p) >= 0
+}
+
+// Best returns the platform in platforms that matches the wanted platform best.
+// A platform with the wanted variant is preferred over a platform with an older variant.
+// Of Windows platforms with the wanted build, the platform with the highest revision that is not newer than the wanted revision is preferred.
+// It returns ErrNoMatchingPlatform if none of platforms matches.
+func (m *PlatformMatcher) Best(platforms []Platform) (Platform, error) {
+	var matches []Platform
+	for _, p := range platforms {
+		if m.Match(p) {
+			matches = append(matches, p)
+		}
+	}
+
+	if len(matches) == 0 {
+		return Platform{}, ErrNoMatchingPlatform
+	}
+
+	sort.SliceStable(matches, func(a, b int) bool {
+		rankA, rankB := m.rank(matches[a]), m.rank(matches[b])
+		if rankA != rankB {
+			return rankA < rankB
+		}
+
+		return m.revisionRank(matches[a].OSVersion) < m.revisionRank(matches[b].OSVersion)
+	})
+	return matches[0], nil
+}
+
+// rank returns the preference of the variant of p, lower is better, or -1 if p does not match.
+func (m *PlatformMatcher) rank(p Platform) int {
+	p = NormalizePlatform(p)
+	if p.OS != m.want.OS || p.Architecture != m.want.Architecture {
+		return -1
+	}
+
+	if p.OS == "windows" && m.want.OSVersion != "" && windowsBuild(p.OSVersion) != windowsBuild(m.want.OSVersion) {
+		return -1
+	}
+
+	return m.variantRank(p.Variant)
+}
+
+// revisionRank returns the preference of a Windows OSVersion, lower is better.
+// Revisions up to the wanted revision are preferred, closest first, followed by newer revisions, closest first.
+// A wanted OSVersion without a revision prefers the highest revision.
+func (m *PlatformMatcher) revisionRank(osVersion string) int64 {
+	if m.want.OS != "windows" || m.want.OSVersion == "" {
+		return 0
+	}
+
+	want, ok := windowsRevision(m.want.OSVersion)
+	if !ok {
+		want = math.MaxInt32
+	}
+
+	rev, ok := windowsRevision(osVersion)
+	if !ok {
+		rev = 0
+	}
+
+	if rev <= want {
+		return want - rev
+	}
+
+	// Newer revisions rank behind all revisions up to the wanted revision.
+	return math.MaxInt32 + rev - want
+}
+
+// variantRank returns the position of variant in the fallbacks of the wanted variant or -1 if variant cannot run on the wanted variant.
+func (m *PlatformMatcher) variantRank(variant string) int {
+	want := m.want.Variant
+	// The first variant of an architecture, e.g. "v1" of "amd64", is commonly left out.
+	if first, ok := firstVariants[m.want.Architecture]; ok {
+		if want == "" {
+			want = first
+		}
+
+		if variant == "" {
+			variant = first
+		}
+	}
+
+	fallbacks := variantFallbacks[m.want.Architecture]
+	for i, v := range fallbacks {
+		if v != want {
+			continue
+		}
+
+		for j := i; j < len(fallbacks); j++ {
+			if fallbacks[j] == variant {
+				return j - i
+			}
+		}
+	}
+
+	if variant == want {
+		return 0
+	}
+
+	return -1
+}
+
+// windowsBuild returns the major, minor and build version of a Windows OSVersion, e.g. "10.0.17763" of "10.0.17763.1457".
+func windowsBuild(osVersion string) string {
+	parts := strings.Split(osVersion, ".")
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// windowsRevision returns the revision of a Windows OSVersion, e.g. 1457 of "10.0.17763.1457".
+func windowsRevision(osVersion string) (int64, bool) {
+	parts := strings.Split(osVersion, ".")
+	if len(parts) < 4 {
+		return 0, false
+	}
+
+	rev, err := strconv.ParseInt(parts[3], 10, 32)
+	return rev, err == nil
+}
+
+// String returns the platform in the format "os/arch[/variant]".
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// platformFromSpec converts the platform of an entry in a manifest list.
+func platformFromSpec(spec manifestlist.PlatformSpec) Platform {
+	return Platform{
+		Architecture: spec.Architecture,
+		Features:     spec.Features,
+		OS:           spec.OS,
+		OSFeatures:   spec.OSFeatures,
+		OSVersion:    spec.OSVersion,
+		Variant:      spec.Variant,
+	}
+}
+
+// GetPlatformManifest returns the manifest of the platform of an image that matches want best.
+// The platform of the running program is used if want is empty.
+// ref can be a tag or a digest and reference a manifest list or the manifest of a single platform.
+func (i *ImageService) GetPlatformManifest(ref string, want Platform) (distribution.Manifest, Platform, error) {
+	return i.GetPlatformManifestContext(context.Background(), ref, want)
+}
+
+// GetPlatformManifestContext returns the manifest of the platform of an image that matches want best.
+// It returns an error that wraps ErrNoMatchingPlatform if no platform of the image matches want.
+// The context controls the lifetime of the requests.
+func (i *ImageService) GetPlatformManifestContext(ctx context.Context, ref string, want Platform) (distribution.Manifest, Platform, error) {
+	m, data, desc, err := i.getManifest(ctx, ref)
+	if err != nil {
+		return nil, Platform{}, err
+	}
+
+	platforms, err := i.platforms(ctx, ref, m, data, desc)
+	if err != nil {
+		return nil, Platform{}, err
+	}
+
+	p, err := NewPlatformMatcher(want).Best(platforms)
+	if err != nil {
+		return nil, p, errors.Wrapf(err, "selecting platform of image '%s'", ref)
+	}
+
+	// The manifest of an image with a single platform has already been fetched.
+	if p.Digest == desc.Digest {
+		return m, p, nil
+	}
+
+	m, _, _, err = i.getManifest(ctx, p.Digest)
+	if err != nil {
+		return nil, p, err
+	}
+
+	return m, p, nil
+}
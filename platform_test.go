@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected Platform
+		err      bool
+	}{
+		{in: "linux/amd64", expected: Platform{OS: "linux", Architecture: "amd64"}},
+		{in: "linux/arm64", expected: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{in: "Linux/aarch64", expected: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{in: "linux/arm/6", expected: Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{in: "linux/armhf", expected: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{in: "linux/x86_64", expected: Platform{OS: "linux", Architecture: "amd64"}},
+		{in: "windows/i386", expected: Platform{OS: "windows", Architecture: "386"}},
+		{in: "linux", err: true},
+		{in: "linux//v7", err: true},
+		{in: "linux/arm/v7/extra", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			p, err := ParsePlatform(tc.in)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, p)
+		})
+	}
+}
+
+func TestPlatformMatcher_Best(t *testing.T) {
+	platforms := []Platform{
+		{OS: "linux", Architecture: "amd64", Digest: "linux-amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v6", Digest: "linux-arm-v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7", Digest: "linux-arm-v7"},
+		{OS: "linux", Architecture: "arm64", Digest: "linux-arm64"},
+		{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1000", Digest: "windows-1809-old"},
+		{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1457", Digest: "windows-1809"},
+		{OS: "windows", Architecture: "amd64", OSVersion: "10.0.19041.508", Digest: "windows-2004"},
+	}
+
+	testCases := []struct {
+		want     Platform
+		expected string
+	}{
+		{want: Platform{OS: "linux", Architecture: "amd64"}, expected: "linux-amd64"},
+		{want: Platform{OS: "linux", Architecture: "aarch64"}, expected: "linux-arm64"},
+		{want: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, expected: "linux-arm64"},
+		{want: Platform{OS: "linux", Architecture: "arm"}, expected: "linux-arm-v7"},
+		{want: Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, expected: "linux-arm-v7"},
+		{want: Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, expected: "linux-arm-v6"},
+		{want: Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, expected: "linux-amd64"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1457"}, expected: "windows-1809"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1500"}, expected: "windows-1809"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1200"}, expected: "windows-1809-old"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.900"}, expected: "windows-1809-old"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763"}, expected: "windows-1809"},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.19041.572"}, expected: "windows-2004"},
+		{want: Platform{OS: "linux", Architecture: "arm", Variant: "v5"}},
+		{want: Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.14393.3930"}},
+		{want: Platform{OS: "linux", Architecture: "s390x"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.want.String()+" "+tc.want.OSVersion, func(t *testing.T) {
+			p, err := NewPlatformMatcher(tc.want).Best(platforms)
+			if tc.expected == "" {
+				assert.Equal(t, ErrNoMatchingPlatform, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, p.Digest)
+		})
+	}
+}
+
+func TestPlatformMatcher_Default(t *testing.T) {
+	m := NewPlatformMatcher(Platform{})
+	assert.True(t, m.Match(Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}))
+	assert.False(t, m.Match(Platform{OS: "plan9", Architecture: runtime.GOARCH}))
+}
+
+func TestImageService_GetPlatformManifest(t *testing.T) {
+	mem := newMemoryRegistry()
+	mem.addTestIndex("e2e", "latest")
+	arm64, _ := mem.addTestImage("e2e", "arm64", "arm64")
+	reg, closeFunc := newTestRegistry(t, mem)
+	defer closeFunc()
+
+	images := reg.Repository("e2e").Images()
+	m, p, err := images.GetPlatformManifest("latest", Platform{OS: "linux", Architecture: "aarch64"})
+	require.NoError(t, err)
+	assert.Equal(t, "arm64", p.Architecture)
+	assert.Equal(t, "v8", p.Variant)
+	manifest, ok := m.(*schema2.DeserializedManifest)
+	require.True(t, ok)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, []byte("layer of arm64"), mem.blobs["e2e@"+manifest.Layers[0].Digest.String()])
+
+	// A manifest of a single platform is returned if the platform matches.
+	_, p, err = images.GetPlatformManifest("arm64", Platform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	assert.Equal(t, arm64, p.Digest)
+
+	_, _, err = images.GetPlatformManifest("latest", Platform{OS: "linux", Architecture: "s390x"})
+	assert.True(t, errors.Is(err, ErrNoMatchingPlatform))
+}
@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the state of the rate limit that a registry enforces, as reported by the registry.
+// Docker Hub reports its rate limit in the headers of responses to manifest requests.
+// See https://docs.docker.com/docker-hub/download-rate-limit/.
+type RateLimit struct {
+	// Limit is the number of requests allowed within Window.
+	Limit int
+	// Remaining is the number of requests left within Window.
+	Remaining int
+	// Source identifies what the rate limit applies to, e.g. an IP address or the ID of an user.
+	Source string
+	// UpdatedAt is the time at which the registry reported the rate limit.
+	UpdatedAt time.Time
+	// Window is the duration of the sliding window in which Limit requests are allowed.
+	Window time.Duration
+}
+
+// IsZero reports whether the registry has not reported a rate limit yet.
+func (rl RateLimit) IsZero() bool {
+	return rl.UpdatedAt.IsZero()
+}
+
+// parseRateLimit reads the rate limit from the headers of a response.
+func parseRateLimit(h http.Header, now time.Time) (RateLimit, bool) {
+	limit, window, ok := parseRateLimitHeader(h.Get("ratelimit-limit"))
+	if !ok {
+		return RateLimit{}, false
+	}
+
+	remaining, remainingWindow, ok := parseRateLimitHeader(h.Get("ratelimit-remaining"))
+	if !ok {
+		return RateLimit{}, false
+	}
+
+	if window == 0 {
+		window = remainingWindow
+	}
+
+	return RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Source:    h.Get("docker-ratelimit-source"),
+		UpdatedAt: now,
+		Window:    window,
+	}, true
+}
+
+// parseRateLimitHeader parses a header in the format "100;w=21600".
+func parseRateLimitHeader(v string) (int, time.Duration, bool) {
+	if v == "" {
+		return 0, 0, false
+	}
+
+	parts := strings.Split(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "w=") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(strings.TrimPrefix(p, "w="))
+		if err == nil {
+			window = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return n, window, true
+}
+
+// rateLimiter records the rate limit reported by a registry and optionally throttles requests.
+type rateLimiter struct {
+	mutex sync.Mutex
+	// next is the earliest time at which the next throttled request can be sent.
+	next  time.Time
+	state RateLimit
+}
+
+func (l *rateLimiter) get() RateLimit {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.state
+}
+
+func (l *rateLimiter) update(resp *http.Response) {
+	rl, ok := parseRateLimit(resp.Header, time.Now())
+	if !ok {
+		return
+	}
+
+	l.mutex.Lock()
+	l.state = rl
+	l.mutex.Unlock()
+}
+
+// wait blocks if the remaining requests reached reserve.
+// Requests are then spaced out so that they are sent at the rate at which the quota recovers.
+func (l *rateLimiter) wait(req *http.Request, reserve int) error {
+	if reserve <= 0 || !countsAgainstRateLimit(req) {
+		return nil
+	}
+
+	l.mutex.Lock()
+	rl := l.state
+	if rl.IsZero() || rl.Remaining > reserve || rl.Limit <= 0 || rl.Window <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+
+	interval := rl.Window / time.Duration(rl.Limit)
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	sendAt := l.next
+	l.next = l.next.Add(interval)
+	l.mutex.Unlock()
+
+	t := time.NewTimer(time.Until(sendAt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// countsAgainstRateLimit reports whether a request counts against the rate limit of Docker Hub.
+func countsAgainstRateLimit(req *http.Request) bool {
+	return req.Method == "GET" && strings.Contains(req.URL.Path, "/manifests/")
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_RateLimit(t *testing.T) {
+	config := `{"architecture":"amd64","os":"linux"}`
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"digest":"%s"},"layers":[]}`, digest.FromString(config))
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			fmt.Fprint(w, config)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Docker-Content-Digest", digest.FromString(manifest).String())
+		w.Header().Set("Docker-Ratelimit-Source", "127.0.0.1")
+		w.Header().Set("Ratelimit-Limit", "100;w=21600")
+		w.Header().Set("Ratelimit-Remaining", "76;w=21600")
+		fmt.Fprint(w, manifest)
+	}))
+	defer closeFunc()
+
+	assert.True(t, reg.RateLimit().IsZero())
+	_, err := reg.Repository("e2e").Images().GetByTag("test")
+	require.NoError(t, err)
+	rl := reg.RateLimit()
+	assert.False(t, rl.IsZero())
+	assert.Equal(t, 100, rl.Limit)
+	assert.Equal(t, 76, rl.Remaining)
+	assert.Equal(t, "127.0.0.1", rl.Source)
+	assert.Equal(t, 6*time.Hour, rl.Window)
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	l := &rateLimiter{state: RateLimit{Limit: 100, Remaining: 5, UpdatedAt: time.Now(), Window: time.Second}}
+	req, err := http.NewRequest("GET", "https://registry.example.com/v2/e2e/manifests/latest", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.wait(req, 5))
+	}
+
+	// The first request is sent immediately, the following ones are spaced out by Window / Limit.
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.next = time.Now().Add(time.Hour)
+	assert.Equal(t, context.Canceled, l.wait(req.WithContext(ctx), 5))
+	assert.NoError(t, l.wait(req, 4), "remaining quota is above the reserve")
+}
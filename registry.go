@@ -1,30 +1,49 @@
 package registry
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
 var (
 	// ErrResourceNotFound indicates that an image is not available in the registry.
+	// Requests return a *ResponseError instead of this error. Use errors.Is() to check if the registry returned status 404 NOT FOUND.
 	ErrResourceNotFound = fmt.Errorf("registry returned status 404 NOT FOUND")
-	// ErrSchemaV1NotSupported indicates that this library does not support registry v1
+	// ErrSchemaV1NotSupported indicates that the registry returned a manifest of schema v1 where a manifest of schema v2 is expected.
+	// Set Options.ConvertSchema1 to convert manifests of schema v1 instead.
 	ErrSchemaV1NotSupported = fmt.Errorf("registry schema v1 is not supported by this library")
 	// ErrSchemaUnknown indicates that the registry returned an unknown manifest schema
 	ErrSchemaUnknown = fmt.Errorf("registry returned an unknown manifest schema")
 )
 
+// manifestAcceptHeader lists all manifest media types that ImageService supports.
+var manifestAcceptHeader = fmt.Sprintf(
+	"%s,%s,%s;q=0.9,%s;q=0.9,%s;q=0.5,%s;q=0.5",
+	schema2.MediaTypeManifest,
+	v1.MediaTypeImageManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageIndex,
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+)
+
 // DefaultClient returns a http.Client with a reasonable timeout.
 func DefaultClient() *http.Client {
 	return &http.Client{
@@ -55,17 +74,37 @@ func ParseImageName(imageName string) (domain, path, tag, digest string, err err
 
 // Options are used to create a new Registry.
 type Options struct {
+	// Authenticator handles authentication against the registry.
+	// Defaults to an Authenticator that detects the authentication scheme of the registry, see NewAuthenticator().
+	// The default Authenticator sends its own requests, e.g. to ping the registry, with Client and retries them according to Retry.
+	// Create an Authenticator with AuthenticatorOptions, e.g. with NewTokenAuthenticatorWithOptions(), to configure its requests.
 	Authenticator Authenticator
 	Client        *http.Client
-	Domain        string
-	Protocol      string
-	Proxy         string
+	// ConvertSchema1 makes ManifestService.Get() convert manifests of schema v1 into manifests of schema v2, see ConvertSchema1().
+	// ManifestService.Get() returns ErrSchemaV1NotSupported for manifests of schema v1 if this is not set.
+	ConvertSchema1 bool
+	Domain         string
+	// Keychain is used to look up the credentials of the registry if no Authenticator is set.
+	Keychain Keychain
+	Protocol string
+	Proxy    string
+	// RateLimitReserve enables throttling of requests that count against the rate limit of the registry, e.g. pulls of manifests from Docker Hub.
+	// Once the registry reports that only RateLimitReserve requests are remaining, requests are delayed
+	// so that they are sent at the rate at which the quota recovers. Throttling is disabled by default.
+	RateLimitReserve int
+	// Retry configures how failed requests are retried. Retries are disabled by default.
+	Retry RetryPolicy
 }
 
 // New returns a new Registry.
 func New(o Options) *Registry {
+	auth := AuthenticatorOptions{Client: o.Client, Retry: o.Retry}
+	if o.Authenticator == nil && o.Keychain != nil {
+		o.Authenticator = NewKeychainAuthenticatorWithOptions(o.Keychain, o.Domain, auth)
+	}
+
 	if o.Authenticator == nil {
-		o.Authenticator = NewNullAuthenticator()
+		o.Authenticator = NewAuthenticatorWithOptions(Credentials{}, auth)
 	}
 
 	if o.Protocol == "" {
@@ -73,20 +112,25 @@ func New(o Options) *Registry {
 	}
 
 	req := &Requester{
-		Domain:   o.Domain,
-		Auth:     o.Authenticator,
-		Client:   o.Client,
-		Protocol: o.Protocol,
-		Proxy:    o.Proxy,
+		Domain:           o.Domain,
+		Auth:             o.Authenticator,
+		Client:           o.Client,
+		Protocol:         o.Protocol,
+		Proxy:            o.Proxy,
+		RateLimitReserve: o.RateLimitReserve,
+		Retry:            o.Retry,
 	}
 	return &Registry{
-		Requester: req,
+		Requester:      req,
+		convertSchema1: o.ConvertSchema1,
 	}
 }
 
 // Registry exposes the repositories in a registry.
 type Registry struct {
 	Requester *Requester
+
+	convertSchema1 bool
 }
 
 type catalogResponse struct {
@@ -95,35 +139,130 @@ type catalogResponse struct {
 
 // Repositories queries the registry and returns all available repositories.
 func (r *Registry) Repositories() ([]*Repository, error) {
-	req, err := r.Requester.NewRequest("GET", "/_catalog", nil)
-	if err != nil {
-		return nil, err
-	}
+	return r.RepositoriesContext(context.Background())
+}
 
-	out := &catalogResponse{}
-	_, err = r.Requester.GetJSON(req, out)
-	if err != nil {
-		return nil, err
+// RepositoriesContext queries the registry and returns all available repositories.
+// The context controls the lifetime of the requests.
+func (r *Registry) RepositoriesContext(ctx context.Context) ([]*Repository, error) {
+	repositories := []*Repository{}
+	it := r.CatalogContext(ctx, CatalogOptions{})
+	for it.Next() {
+		repositories = append(repositories, it.Repository())
 	}
 
-	repositories := []*Repository{}
-	for _, repoName := range out.Repositories {
-		repositories = append(repositories, r.Repository(repoName))
+	if it.Err() != nil {
+		return nil, it.Err()
 	}
 
 	return repositories, nil
 }
 
+// CatalogOptions configure the listing of the repositories in a registry.
+type CatalogOptions struct {
+	ListOptions
+	// Prefix limits the listing to repositories whose names start with Prefix, e.g. a namespace like "team/".
+	// The registry lists repositories in lexical order, so the listing starts right before Prefix
+	// and stops at the first repository that sorts after the repositories with Prefix.
+	Prefix string
+}
+
+// Catalog returns a CatalogIterator that iterates over the repositories in the registry.
+// Pages are requested as the iterator advances.
+func (r *Registry) Catalog(opts CatalogOptions) *CatalogIterator {
+	return r.CatalogContext(context.Background(), opts)
+}
+
+// CatalogContext returns a CatalogIterator that iterates over the repositories in the registry.
+// The context controls the lifetime of the requests.
+func (r *Registry) CatalogContext(ctx context.Context, opts CatalogOptions) *CatalogIterator {
+	if start := catalogStart(opts.Prefix); start > opts.Last {
+		opts.Last = start
+	}
+
+	return &CatalogIterator{
+		it: &listIterator{
+			decode: func(p *pager) ([]string, error) {
+				out := catalogResponse{}
+				err := p.fetch(&out)
+				return out.Repositories, errors.Wrap(err, "reading catalog")
+			},
+			last:  opts.Last,
+			pager: &pager{ctx: ctx, opts: opts.ListOptions, path: "/_catalog", r: r.Requester},
+		},
+		prefix: opts.Prefix,
+		reg:    r,
+	}
+}
+
+// catalogStart returns the value of the parameter "last" that makes the registry list the repositories with prefix first.
+// It is the prefix with its last byte decremented, which sorts right before all names that start with prefix.
+func catalogStart(prefix string) string {
+	if prefix == "" || prefix[len(prefix)-1] == 0 {
+		return ""
+	}
+
+	return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]-1)
+}
+
+// CatalogIterator iterates over the repositories in a registry.
+type CatalogIterator struct {
+	done   bool
+	it     *listIterator
+	prefix string
+	reg    *Registry
+}
+
+// Next advances the iterator to the next repository. It returns false if there are no more repositories or an error occurred.
+func (it *CatalogIterator) Next() bool {
+	for !it.done && it.it.next() {
+		if strings.HasPrefix(it.it.last, it.prefix) {
+			return true
+		}
+
+		// No more repositories with the prefix follow a repository that sorts after the prefix.
+		it.done = it.it.last > it.prefix
+	}
+
+	return false
+}
+
+// Err returns the error that stopped the iteration.
+func (it *CatalogIterator) Err() error {
+	return it.it.err
+}
+
+// Last returns the name of the repository that Next advanced to last.
+// Pass it as ListOptions.Last to resume the iteration after that repository.
+func (it *CatalogIterator) Last() string {
+	return it.it.last
+}
+
+// Repository returns the repository that the iterator currently points to.
+func (it *CatalogIterator) Repository() *Repository {
+	return it.reg.Repository(it.it.last)
+}
+
+// RateLimit returns the latest known state of the rate limit of the registry.
+// The state is updated with every response that contains information about the rate limit.
+// Use RateLimit.IsZero() to check if the registry reported a rate limit.
+func (r *Registry) RateLimit() RateLimit {
+	return r.Requester.RateLimit()
+}
+
 // Repository returns one repository in the registry.
 // It does not check if the repository actually exists in the registry.
 func (r *Registry) Repository(name string) *Repository {
 	repo := &Repository{
+		blobService:     &BlobService{r: r.Requester},
 		domain:          r.Requester.Domain,
 		imageService:    &ImageService{r: r.Requester},
 		manifestService: &ManifestService{r: r.Requester},
 		name:            name,
+		registry:        r,
 		tagService:      &TagService{r: r.Requester},
 	}
+	repo.blobService.repo = repo
 	repo.imageService.repo = repo
 	repo.manifestService.repo = repo
 	repo.tagService.repo = repo
@@ -146,6 +285,7 @@ func (r *Registry) RepositoryFromString(name string) (*Repository, error) {
 
 // Repository exposes the images in a repository in a registry.
 type Repository struct {
+	blobService     *BlobService
 	domain          string
 	imageService    *ImageService
 	manifestService *ManifestService
@@ -154,6 +294,11 @@ type Repository struct {
 	tagService      *TagService
 }
 
+// Blobs returns a BlobService.
+func (r *Repository) Blobs() *BlobService {
+	return r.blobService
+}
+
 // Domain returns the domain of the registry that the repository belongs to.
 func (r *Repository) Domain() string {
 	return r.domain
@@ -196,20 +341,210 @@ type ManifestService struct {
 
 // Get returns the manifest schema v2 of an image.
 func (p *ManifestService) Get(digest string) (schema2.Manifest, error) {
+	return p.GetContext(context.Background(), digest)
+}
+
+// GetContext returns the manifest schema v2 of an image.
+// The context controls the lifetime of the request.
+// A manifest of schema v1 is converted if Options.ConvertSchema1 is set.
+func (p *ManifestService) GetContext(ctx context.Context, digest string) (schema2.Manifest, error) {
 	var m schema2.Manifest
-	path := fmt.Sprintf("/manifests/%s", digest)
-	req, err := p.r.NewRequest("GET", p.repo.httpPath(path), nil)
+	accept := schema2.MediaTypeManifest
+	if p.convertSchema1() {
+		accept = fmt.Sprintf("%s,%s;q=0.5,%s;q=0.5", schema2.MediaTypeManifest, schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest)
+	}
+
+	data, desc, err := p.getRaw(ctx, digest, accept)
 	if err != nil {
 		return m, err
 	}
 
-	req.Header.Add("Accept", schema2.MediaTypeManifest)
-	_, err = p.r.GetJSON(req, &m)
+	if !isSchema1(desc.MediaType, data) {
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return m, errors.Wrapf(err, "unmarshalling manifest '%s'", digest)
+		}
+
+		return m, nil
+	}
+
+	if !p.convertSchema1() {
+		return m, ErrSchemaV1NotSupported
+	}
+
+	signed, err := unmarshalSchema1(data)
 	if err != nil {
-		return m, errors.Wrapf(err, "reading manifest '%s'", digest)
+		return m, errors.Wrapf(err, "unmarshalling manifest '%s'", digest)
 	}
 
-	return m, nil
+	m, _, err = ConvertSchema1(signed)
+	return m, errors.Wrapf(err, "converting manifest '%s'", digest)
+}
+
+// GetOCI returns the OCI image manifest of an image.
+func (p *ManifestService) GetOCI(digest string) (ocischema.Manifest, error) {
+	return p.GetOCIContext(context.Background(), digest)
+}
+
+// GetOCIContext returns the OCI image manifest of an image.
+// The context controls the lifetime of the request.
+func (p *ManifestService) GetOCIContext(ctx context.Context, digest string) (ocischema.Manifest, error) {
+	var m ocischema.Manifest
+	err := p.getJSON(ctx, digest, v1.MediaTypeImageManifest, &m)
+	return m, err
+}
+
+// GetRaw returns the manifest that ref references exactly as the registry sent it.
+// It accepts all media types that ImageService supports.
+func (p *ManifestService) GetRaw(ref string) ([]byte, Descriptor, error) {
+	return p.GetRawContext(context.Background(), ref)
+}
+
+// GetRawContext returns the manifest that ref references exactly as the registry sent it.
+// The manifest is verified against ref if ref is a digest and against the digest that the registry returned.
+// It returns a *DigestMismatchError if verification fails.
+// The context controls the lifetime of the request.
+func (p *ManifestService) GetRawContext(ctx context.Context, ref string) ([]byte, Descriptor, error) {
+	return p.getRaw(ctx, ref, manifestAcceptHeader)
+}
+
+// Put uploads a manifest and tags it with ref. Pass a digest as ref to upload the manifest without a tag.
+// It supports manifests of schema v2, manifest lists, OCI image manifests and OCI image indexes.
+// The blobs referenced by the manifest need to exist in the repository.
+// It returns the digest of the manifest.
+func (p *ManifestService) Put(ref string, m distribution.Manifest) (string, error) {
+	return p.PutContext(context.Background(), ref, m)
+}
+
+// PutContext uploads a manifest and tags it with ref.
+// The context controls the lifetime of the request.
+// It returns an error that wraps ErrDigestMismatch if the registry computed a different digest for the manifest.
+// Manifests of schema v1 cannot be uploaded and return an error that wraps ErrSchemaV1NotSupported.
+func (p *ManifestService) PutContext(ctx context.Context, ref string, m distribution.Manifest) (string, error) {
+	// The digest of a manifest of schema v1 is computed from its payload without the signatures and an unsigned one has no payload.
+	if _, ok := m.(*schema1.SignedManifest); ok {
+		return "", errors.Wrapf(ErrSchemaV1NotSupported, "uploading manifest '%s'", ref)
+	}
+
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return "", errors.Wrap(err, "reading payload of manifest")
+	}
+
+	if len(payload) == 0 {
+		return "", fmt.Errorf("uploading manifest '%s': payload of manifest is empty", ref)
+	}
+
+	dgst := digest.FromBytes(payload)
+	if d, err := digest.Parse(ref); err == nil && d != dgst {
+		return "", errors.Wrapf(ErrDigestMismatch, "uploading manifest with digest '%s' as '%s'", dgst, ref)
+	}
+
+	path := fmt.Sprintf("/manifests/%s", ref)
+	req, err := p.r.NewRequestContext(ctx, "PUT", p.repo.httpPath(path), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := p.r.SendRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkResponse(resp, http.StatusCreated)
+	if err != nil {
+		return "", errors.Wrapf(err, "uploading manifest '%s'", ref)
+	}
+
+	resp.Body.Close()
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != dgst.String() {
+		return "", errors.Wrapf(ErrDigestMismatch, "registry returned digest '%s' for manifest with digest '%s'", d, dgst)
+	}
+
+	return dgst.String(), nil
+}
+
+func (p *ManifestService) convertSchema1() bool {
+	return p.repo.registry != nil && p.repo.registry.convertSchema1
+}
+
+func (p *ManifestService) getJSON(ctx context.Context, digest, mediaType string, out interface{}) error {
+	data, _, err := p.getRaw(ctx, digest, mediaType)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return errors.Wrapf(err, "unmarshalling manifest '%s'", digest)
+	}
+
+	return nil
+}
+
+// getRaw requests the manifest identified by ref in any of the media types in accept and verifies its digest.
+func (p *ManifestService) getRaw(ctx context.Context, ref, accept string) ([]byte, Descriptor, error) {
+	var desc Descriptor
+	path := fmt.Sprintf("/manifests/%s", ref)
+	req, err := p.r.NewRequestContext(ctx, "GET", p.repo.httpPath(path), nil)
+	if err != nil {
+		return nil, desc, err
+	}
+
+	req.Header.Add("Accept", accept)
+	data, headers, err := p.r.GetByte(req)
+	if err != nil {
+		return nil, desc, errors.Wrapf(err, "reading manifest '%s'", ref)
+	}
+
+	desc.MediaType = headers.Get("Content-Type")
+	desc.Size = int64(len(data))
+	dgst, err := verifyManifest(ref, headers.Get("Docker-Content-Digest"), desc.MediaType, data)
+	if err != nil {
+		return nil, desc, err
+	}
+
+	desc.Digest = dgst.String()
+	return data, desc, nil
+}
+
+// verifyManifest computes the digest of a manifest and compares it to ref, if ref is a digest, and to the digest in header.
+// The digest of a signed manifest of schema v1 is computed from its payload without the signatures, like registries do.
+func verifyManifest(ref, header, mediaType string, data []byte) (digest.Digest, error) {
+	canonical := data
+	if isSchema1(mediaType, data) {
+		signed, err := unmarshalSchema1(data)
+		if err != nil {
+			return "", errors.Wrapf(err, "unmarshalling manifest '%s'", ref)
+		}
+
+		canonical = signed.Canonical
+	}
+
+	dgst := digest.FromBytes(canonical)
+	expected := []string{header}
+	if d, err := digest.Parse(ref); err == nil {
+		dgst = d.Algorithm().FromBytes(canonical)
+		expected = append(expected, ref)
+	}
+
+	for _, e := range expected {
+		if e == "" {
+			continue
+		}
+
+		d, err := digest.Parse(e)
+		if err != nil {
+			return "", errors.Wrapf(err, "parsing digest '%s' of manifest '%s'", e, ref)
+		}
+
+		if actual := d.Algorithm().FromBytes(canonical); actual != d {
+			return "", &DigestMismatchError{Actual: actual.String(), Expected: e}
+		}
+	}
+
+	return dgst, nil
 }
 
 // Platform is the platform on which an image can run.
@@ -238,6 +573,7 @@ type Image struct {
 }
 
 // ImageService exposes images.
+// It supports images with a manifest of schema v1, a manifest of schema v2, a manifest list, an OCI image manifest or an OCI image index.
 type ImageService struct {
 	r    *Requester
 	repo *Repository
@@ -245,8 +581,14 @@ type ImageService struct {
 
 // DeleteByDigest deletes an image. It uses the digest of an image to reference it.
 func (i *ImageService) DeleteByDigest(digest string) error {
+	return i.DeleteByDigestContext(context.Background(), digest)
+}
+
+// DeleteByDigestContext deletes an image. It uses the digest of an image to reference it.
+// The context controls the lifetime of the request.
+func (i *ImageService) DeleteByDigestContext(ctx context.Context, digest string) error {
 	path := fmt.Sprintf("/manifests/%s", digest)
-	req, err := i.r.NewRequest("DELETE", i.repo.httpPath(path), nil)
+	req, err := i.r.NewRequestContext(ctx, "DELETE", i.repo.httpPath(path), nil)
 	if err != nil {
 		return err
 	}
@@ -256,22 +598,26 @@ func (i *ImageService) DeleteByDigest(digest string) error {
 		return err
 	}
 
-	if resp.StatusCode == http.StatusNotFound {
-		return ErrResourceNotFound
-	}
-
-	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("deleting image returned status code %d expected 202", resp.StatusCode)
+	err = checkResponse(resp, http.StatusAccepted)
+	if err != nil {
+		return errors.Wrap(err, "deleting image")
 	}
 
+	resp.Body.Close()
 	return nil
 }
 
 // GetByDigest queries the repository for an image identified by its digest.
 // The `Tag` field of an image returned by this method always is an empty string.
 func (i *ImageService) GetByDigest(digest string) (Image, error) {
+	return i.GetByDigestContext(context.Background(), digest)
+}
+
+// GetByDigestContext queries the repository for an image identified by its digest.
+// The context controls the lifetime of the request.
+func (i *ImageService) GetByDigestContext(ctx context.Context, digest string) (Image, error) {
 	var img Image
-	img, err := i.get(digest)
+	img, err := i.get(ctx, digest)
 	if err != nil {
 		return img, err
 	}
@@ -283,8 +629,14 @@ func (i *ImageService) GetByDigest(digest string) (Image, error) {
 
 // GetByTag queries the repository for an image identified by its tag.
 func (i *ImageService) GetByTag(tag string) (Image, error) {
+	return i.GetByTagContext(context.Background(), tag)
+}
+
+// GetByTagContext queries the repository for an image identified by its tag.
+// The context controls the lifetime of the request.
+func (i *ImageService) GetByTagContext(ctx context.Context, tag string) (Image, error) {
 	var img Image
-	img, err := i.get(tag)
+	img, err := i.get(ctx, tag)
 	if err != nil {
 		return img, err
 	}
@@ -295,61 +647,149 @@ func (i *ImageService) GetByTag(tag string) (Image, error) {
 	return img, nil
 }
 
-func (i *ImageService) get(ref string) (Image, error) {
-	var img Image
+// Resolve returns the descriptor of the manifest that a tag or digest references without downloading the manifest.
+func (i *ImageService) Resolve(ref string) (Descriptor, error) {
+	return i.ResolveContext(context.Background(), ref)
+}
+
+// ResolveContext returns the descriptor of the manifest that a tag or digest references without downloading the manifest.
+// It sends a HEAD request, which registries like Docker Hub do not count against their pull limits.
+// If the registry does not return the digest of the manifest, it falls back to downloading and hashing the manifest.
+// The context controls the lifetime of the requests.
+func (i *ImageService) ResolveContext(ctx context.Context, ref string) (Descriptor, error) {
+	var desc Descriptor
 	path := fmt.Sprintf("/manifests/%s", ref)
-	req, err := i.r.NewRequest("GET", i.repo.httpPath(path), nil)
+	req, err := i.r.NewRequestContext(ctx, "HEAD", i.repo.httpPath(path), nil)
 	if err != nil {
-		return img, err
+		return desc, err
 	}
 
-	req.Header.Add("Accept", fmt.Sprintf("%s,%s;q=0.9", schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList))
-	data, headers, err := i.r.GetByte(req)
+	req.Header.Add("Accept", manifestAcceptHeader)
+	resp, err := i.r.SendRequest(req)
 	if err != nil {
-		return img, err
+		return desc, err
 	}
 
-	m, _, err := distribution.UnmarshalManifest(headers.Get("Content-Type"), data)
+	err = checkResponse(resp, http.StatusOK)
 	if err != nil {
-		return img, errors.Wrapf(err, "unmarshalling manifest '%s'", ref)
+		return desc, errors.Wrapf(err, "resolving manifest '%s'", ref)
 	}
 
-	img.Digest = headers.Get("Docker-Content-Digest")
+	resp.Body.Close()
+
+	desc.Digest = resp.Header.Get("Docker-Content-Digest")
+	if desc.Digest == "" {
+		return i.resolveByGet(ctx, ref)
+	}
+
+	desc.MediaType = resp.Header.Get("Content-Type")
+	desc.Size, err = contentLength(resp)
+	if err != nil {
+		return desc, errors.Wrapf(err, "reading size of manifest '%s'", ref)
+	}
+
+	return desc, nil
+}
+
+// resolveByGet downloads a manifest and computes its digest.
+func (i *ImageService) resolveByGet(ctx context.Context, ref string) (Descriptor, error) {
+	_, desc, err := i.repo.Manifests().GetRawContext(ctx, ref)
+	return desc, err
+}
+
+func (i *ImageService) get(ctx context.Context, ref string) (Image, error) {
+	var img Image
+	m, data, desc, err := i.getManifest(ctx, ref)
+	if err != nil {
+		return img, err
+	}
+
+	img.Digest = desc.Digest
+	img.Platforms, err = i.platforms(ctx, ref, m, data, desc)
+	return img, err
+}
+
+// platforms returns the platforms of the manifest m.
+// data is the raw content of m and desc describes it.
+func (i *ImageService) platforms(ctx context.Context, ref string, m distribution.Manifest, data []byte, desc Descriptor) ([]Platform, error) {
+	var platforms []Platform
 	switch manifest := m.(type) {
-	case *schema2.DeserializedManifest:
-		p := Platform{
-			Architecture: "amd64",
-			Digest:       headers.Get("Docker-Content-Digest"),
-			Features:     []string{},
-			MediaType:    headers.Get("Content-Type"),
-			OS:           "linux",
-			OSFeatures:   []string{},
-			OSVersion:    "",
-			Size:         0,
-			Variant:      "",
+	case *schema2.DeserializedManifest, *ocischema.DeserializedManifest:
+		p, err := i.platformFromConfig(ctx, configDigest(manifest))
+		if err != nil {
+			return nil, err
 		}
-		img.Platforms = append(img.Platforms, p)
+
+		p.Digest = desc.Digest
+		p.MediaType = desc.MediaType
+		p.Size = len(data)
+		platforms = append(platforms, p)
 	case *manifestlist.DeserializedManifestList:
 		for _, platformManifest := range manifest.Manifests {
-			img.Platforms = append(img.Platforms, Platform{
-				Architecture: platformManifest.Platform.Architecture,
-				Digest:       platformManifest.Digest.String(),
-				Features:     platformManifest.Platform.Features,
-				MediaType:    platformManifest.MediaType,
-				OS:           platformManifest.Platform.OS,
-				OSFeatures:   platformManifest.Platform.OSFeatures,
-				OSVersion:    platformManifest.Platform.OSVersion,
-				Size:         int(platformManifest.Size),
-				Variant:      platformManifest.Platform.Variant,
-			})
+			p := platformFromSpec(platformManifest.Platform)
+			p.Digest = platformManifest.Digest.String()
+			p.MediaType = platformManifest.MediaType
+			p.Size = int(platformManifest.Size)
+			platforms = append(platforms, p)
 		}
 	case *schema1.SignedManifest:
-		return img, ErrSchemaV1NotSupported
+		p, err := schema1Platform(manifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading platform of manifest '%s'", ref)
+		}
+
+		p.Digest = desc.Digest
+		p.Size = len(data)
+		platforms = append(platforms, p)
 	default:
-		return img, ErrSchemaUnknown
+		return nil, ErrSchemaUnknown
 	}
 
-	return img, nil
+	return platforms, nil
+}
+
+// getManifest requests the manifest identified by ref in any of the media types that ImageService supports.
+// The manifest is verified against its digest.
+func (i *ImageService) getManifest(ctx context.Context, ref string) (distribution.Manifest, []byte, Descriptor, error) {
+	data, desc, err := i.repo.Manifests().GetRawContext(ctx, ref)
+	if err != nil {
+		return nil, nil, desc, err
+	}
+
+	var m distribution.Manifest
+	if isSchema1(desc.MediaType, data) {
+		m, err = unmarshalSchema1(data)
+	} else {
+		m, _, err = distribution.UnmarshalManifest(desc.MediaType, data)
+	}
+
+	if err != nil {
+		return nil, nil, desc, errors.Wrapf(err, "unmarshalling manifest '%s'", ref)
+	}
+
+	return m, data, desc, nil
+}
+
+// platformFromConfig reads the platform of an image from its configuration blob.
+// Manifests of schema v2 and OCI image manifests do not contain the platform of an image.
+func (i *ImageService) platformFromConfig(ctx context.Context, dgst string) (Platform, error) {
+	var p Platform
+	config, err := i.getConfigBlob(ctx, dgst)
+	if err != nil {
+		return p, err
+	}
+
+	p.Architecture = config.Architecture
+	p.Features = []string{}
+	p.OS = config.OS
+	p.OSFeatures = config.OSFeatures
+	if p.OSFeatures == nil {
+		p.OSFeatures = []string{}
+	}
+
+	p.OSVersion = config.OSVersion
+	p.Variant = config.Variant
+	return p, nil
 }
 
 type tagGetAllResponse struct {
@@ -363,21 +803,110 @@ type TagService struct {
 }
 
 // GetAll returns all tags in the repository.
-// Note that this method does not implement pagination as described in the official documentation of the Docker Registry API V2
-// as the spec has not been implemented in the registry. See https://github.com/docker/distribution/issues/1936 for more information.
+// It requests all pages if the registry paginates the list of tags.
 func (r *TagService) GetAll() ([]string, error) {
-	req, err := r.r.NewRequest("GET", r.repo.httpPath("/tags/list"), nil)
-	if err != nil {
-		return nil, err
+	return r.GetAllContext(context.Background())
+}
+
+// GetAllContext returns all tags in the repository.
+// The context controls the lifetime of the requests.
+func (r *TagService) GetAllContext(ctx context.Context) ([]string, error) {
+	tags := []string{}
+	it := r.IteratorContext(ctx, ListOptions{})
+	for it.Next() {
+		tags = append(tags, it.Tag())
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
 	}
 
+	return tags, nil
+}
+
+// TagPage is one page of tags in a repository.
+type TagPage struct {
+	// Next is the cursor to pass as ListOptions.Last to request the next page.
+	// It is empty if this is the last page.
+	Next string
+	Tags []string
+}
+
+// GetPage returns one page of tags in the repository.
+func (r *TagService) GetPage(opts ListOptions) (TagPage, error) {
+	return r.GetPageContext(context.Background(), opts)
+}
+
+// GetPageContext returns one page of tags in the repository.
+// The context controls the lifetime of the request.
+func (r *TagService) GetPageContext(ctx context.Context, opts ListOptions) (TagPage, error) {
+	p := r.newPager(ctx, opts)
 	tagsResponse := tagGetAllResponse{}
-	_, err = r.r.GetJSON(req, &tagsResponse)
+	err := p.fetch(&tagsResponse)
 	if err != nil {
-		return nil, errors.Wrap(err, "reading tags")
+		return TagPage{}, errors.Wrap(err, "reading tags")
+	}
+
+	var last string
+	if len(tagsResponse.Tags) > 0 {
+		last = tagsResponse.Tags[len(tagsResponse.Tags)-1]
 	}
 
-	return tagsResponse.Tags, nil
+	return TagPage{Next: p.nextCursor(last), Tags: tagsResponse.Tags}, nil
+}
+
+// Iterator returns a TagIterator that iterates over the tags in the repository.
+// Pages are requested as the iterator advances.
+func (r *TagService) Iterator(opts ListOptions) *TagIterator {
+	return r.IteratorContext(context.Background(), opts)
+}
+
+// IteratorContext returns a TagIterator that iterates over the tags in the repository.
+// The context controls the lifetime of the requests.
+func (r *TagService) IteratorContext(ctx context.Context, opts ListOptions) *TagIterator {
+	return &TagIterator{it: &listIterator{
+		decode: func(p *pager) ([]string, error) {
+			tagsResponse := tagGetAllResponse{}
+			err := p.fetch(&tagsResponse)
+			return tagsResponse.Tags, errors.Wrap(err, "reading tags")
+		},
+		last:  opts.Last,
+		pager: r.newPager(ctx, opts),
+	}}
+}
+
+func (r *TagService) newPager(ctx context.Context, opts ListOptions) *pager {
+	return &pager{ctx: ctx, opts: opts, path: r.repo.httpPath("/tags/list"), r: r.r}
+}
+
+// TagIterator iterates over the tags in a repository.
+//
+//	it := repo.Tags().Iterator(registry.ListOptions{PageSize: 100})
+//	for it.Next() {
+//		fmt.Println(it.Tag())
+//	}
+//
+//	if it.Err() != nil {
+//		log.Fatal(it.Err())
+//	}
+type TagIterator struct {
+	it *listIterator
+}
+
+// Next advances the iterator to the next tag. It returns false if there are no more tags or an error occurred.
+func (it *TagIterator) Next() bool {
+	return it.it.next()
+}
+
+// Err returns the error that stopped the iteration.
+func (it *TagIterator) Err() error {
+	return it.it.err
+}
+
+// Tag returns the tag that the iterator currently points to.
+// Pass it as ListOptions.Last to resume the iteration after that tag.
+func (it *TagIterator) Tag() string {
+	return it.it.last
 }
 
 // Requester handles all communication with the Docker registry.
@@ -387,9 +916,20 @@ type Requester struct {
 	Domain   string
 	Protocol string
 	Proxy    string
+	// RateLimitReserve is the number of remaining requests at which requests are throttled. See Options.RateLimitReserve.
+	RateLimitReserve int
+	Retry            RetryPolicy
+
+	limiter rateLimiter
+}
+
+// RateLimit returns the rate limit that the registry reported in its latest response.
+func (r *Requester) RateLimit() RateLimit {
+	return r.limiter.get()
 }
 
 // GetByte sends a request and returns the payload of the response as bytes.
+// It returns a *ResponseError if the registry does not respond with status 200.
 func (r *Requester) GetByte(req *http.Request) ([]byte, http.Header, error) {
 	resp, err := r.SendRequest(req)
 	if err != nil {
@@ -397,8 +937,9 @@ func (r *Requester) GetByte(req *http.Request) ([]byte, http.Header, error) {
 	}
 
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, nil, ErrResourceNotFound
+	err = checkResponse(resp, http.StatusOK)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
@@ -424,8 +965,24 @@ func (r *Requester) GetJSON(req *http.Request, out interface{}) (http.Header, er
 	return headers, nil
 }
 
+// newRequestURL creates a new request to an absolute URL returned by the registry, e.g. in a Link or Location header.
+func (r *Requester) newRequestURL(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.WithContext(ctx), nil
+}
+
 // NewRequest creates a new request to send to the registry.
 func (r *Requester) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	return r.NewRequestContext(context.Background(), method, path, body)
+}
+
+// NewRequestContext creates a new request to send to the registry.
+// The context of the request controls its lifetime, including the requests sent by the Authenticator.
+func (r *Requester) NewRequestContext(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
 	domain := r.Domain
 	if domain == "docker.io" {
 		domain = "index.docker.io"
@@ -436,28 +993,51 @@ func (r *Requester) NewRequest(method, path string, body io.Reader) (*http.Reque
 	}
 
 	url := fmt.Sprintf("%s://%s/v2%s", r.Protocol, domain, path)
-	return http.NewRequest(method, url, body)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.WithContext(ctx), nil
 }
 
 // SendRequest sends a request to the registry.
 // It also handles authentication.
+// Sending the request is aborted if the context of the request is canceled.
+// Failed requests are retried according to the RetryPolicy.
 func (r *Requester) SendRequest(req *http.Request) (*http.Response, error) {
 	err := r.Auth.HandleRequest(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "handling authenticator request")
 	}
 
-	resp, err := r.Client.Do(req)
+	err = r.limiter.wait(req, r.RateLimitReserve)
+	if err != nil {
+		return nil, errors.Wrap(err, "waiting for rate limit")
+	}
+
+	resp, err := r.Retry.do(req, r.Client.Do)
 	if err != nil {
 		return nil, errors.Wrapf(err, "querying '%s'", req.URL.String())
 	}
 
+	r.limiter.update(resp)
+
 	resp, resend, err := r.Auth.HandleResponse(resp)
 	if err != nil {
 		return nil, errors.Wrap(err, "handling authenticator response")
 	}
 
 	if resend {
+		if !canRewindBody(req) {
+			return nil, fmt.Errorf("cannot send request '%s %s' again after authenticating because its body cannot be read again", req.Method, req.URL.String())
+		}
+
+		err = rewindBody(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "rewinding body of request")
+		}
+
 		return r.SendRequest(req)
 	}
 
@@ -2,6 +2,8 @@ package registry
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,6 +33,83 @@ func TestParseImageName_Digest(t *testing.T) {
 	assert.Equal(t, "sha256:3d2e482b82608d153a374df3357c0291589a61cc194ec4a9ca2381073a17f58e", digest)
 }
 
+func catalogHandler(t *testing.T) http.HandlerFunc {
+	all := []string{"other/a", "team/a", "team/b", "team/c", "zzz"}
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/_catalog", r.URL.Path)
+		// The registry lists the names that sort after the parameter "last".
+		start := len(all)
+		for i, name := range all {
+			if name > r.URL.Query().Get("last") {
+				start = i
+				break
+			}
+		}
+
+		end := start + 2
+		if end < len(all) {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s/v2/_catalog?last=%s&n=2>; rel="next"`, r.Host, all[end-1]))
+		} else {
+			end = len(all)
+		}
+
+		fmt.Fprintf(w, `{"repositories":["%s"]}`, strings.Join(all[start:end], `","`))
+	}
+}
+
+func TestRegistry_Repositories_Pagination(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, catalogHandler(t))
+	defer closeFunc()
+
+	repos, err := reg.Repositories()
+	require.NoError(t, err)
+	var names []string
+	for _, r := range repos {
+		names = append(names, r.Name())
+	}
+
+	assert.Equal(t, []string{"other/a", "team/a", "team/b", "team/c", "zzz"}, names)
+}
+
+func TestRegistry_Catalog_Prefix(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, catalogHandler(t))
+	defer closeFunc()
+
+	it := reg.Catalog(CatalogOptions{Prefix: "team/"})
+	require.True(t, it.Next())
+	assert.Equal(t, "team/a", it.Repository().Name())
+
+	var names []string
+	it = reg.Catalog(CatalogOptions{ListOptions: ListOptions{Last: it.Last()}, Prefix: "team/"})
+	for it.Next() {
+		names = append(names, it.Repository().Name())
+	}
+
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"team/b", "team/c"}, names)
+}
+
+func TestRegistry_Catalog_PrefixStopsPaging(t *testing.T) {
+	var lasts []string
+	h := catalogHandler(t)
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lasts = append(lasts, r.URL.Query().Get("last"))
+		h(w, r)
+	}))
+	defer closeFunc()
+
+	var names []string
+	it := reg.Catalog(CatalogOptions{Prefix: "other/"})
+	for it.Next() {
+		names = append(names, it.Repository().Name())
+	}
+
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"other/a"}, names)
+	// The listing starts right before the prefix and stops at "team/a" without requesting the other pages.
+	assert.Equal(t, []string{"other."}, lasts)
+}
+
 func listingRepositoriesIn(domain string) error {
 	reg := New(Options{
 		Client:   DefaultClient(),
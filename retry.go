@@ -0,0 +1,178 @@
+package registry
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 1 * time.Minute
+)
+
+// RetryPolicy configures how requests are retried if the registry responds with status 429 TOO MANY REQUESTS or a server error.
+// Requests that fail because of a network error are also retried.
+// Only requests with idempotent methods, e.g. GET or HEAD, and requests to a token service are retried.
+// The zero value disables retries.
+type RetryPolicy struct {
+	// InitialBackoff is the time to wait before the first retry.
+	// The time doubles with each retry and a random jitter is applied. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// MaxAttempts is the maximum number of times a request is sent. A value lower than 2 disables retries.
+	MaxAttempts int
+	// MaxBackoff is the maximum time to wait between two attempts.
+	// It also caps the time requested by the registry in the Retry-After header. Defaults to 1 minute.
+	MaxBackoff time.Duration
+}
+
+// do sends req using send and retries it according to the policy.
+// Requests with a method that is not idempotent are not retried.
+func (p RetryPolicy) do(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	return p.doRetry(req, send, isIdempotent(req.Method))
+}
+
+// doIdempotent sends req using send and retries it according to the policy, regardless of its method.
+// The caller guarantees that sending req multiple times has the same effect as sending it once.
+func (p RetryPolicy) doIdempotent(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	return p.doRetry(req, send, true)
+}
+
+func (p RetryPolicy) doRetry(req *http.Request, send func(*http.Request) (*http.Response, error), idempotent bool) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req)
+		if attempt >= p.MaxAttempts || !idempotent || !isRetryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := p.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		err = rewindBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff returns the time to wait before the next attempt.
+func (p RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	if wait, ok := retryAfter(resp); ok {
+		if wait > max {
+			return max
+		}
+
+		return wait
+	}
+
+	wait := initial << uint(attempt-1)
+	if wait > max || wait <= 0 {
+		wait = max
+	}
+
+	// Apply jitter so that concurrent clients do not retry at the same time.
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryAfter parses the Retry-After header, which contains either seconds or a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(h); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(h); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+
+		return wait, true
+	}
+
+	return 0, false
+}
+
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if !canRewindBody(req) {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// isIdempotent reports whether sending a request with method multiple times has the same effect as sending it once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "DELETE", "GET", "HEAD", "OPTIONS", "PUT":
+		return true
+	}
+
+	return false
+}
+
+// canRewindBody reports whether the body of a request can be recreated so that the request can be sent again.
+func canRewindBody(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewindBody recreates the body of a request so that it can be sent again.
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody == nil {
+		return nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+
+	req.Body = body
+	return nil
+}
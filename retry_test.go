@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequester_SendRequest_Retry(t *testing.T) {
+	var attempts int32
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			fmt.Fprint(w, `{"tags":["latest"]}`)
+		}
+	}))
+	defer closeFunc()
+
+	reg.Requester.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 3}
+	tags, err := reg.Repository("e2e").Tags().GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, tags)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestRequester_SendRequest_RetryExhausted(t *testing.T) {
+	var attempts int32
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 2}
+	_, err := reg.Repository("e2e").Tags().GetAll()
+	var respErr *ResponseError
+	require.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusServiceUnavailable, respErr.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestRequester_SendRequest_RetryOnlyIdempotent(t *testing.T) {
+	var attempts int32
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 3}
+	req, err := reg.Requester.NewRequest("POST", "/e2e/blobs/uploads/", strings.NewReader("data"))
+	require.NoError(t, err)
+	resp, err := reg.Requester.SendRequest(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestTokenAuthenticator_RetriesTokenPost(t *testing.T) {
+	var attempts int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprint(w, `{"access_token":"abc123"}`)
+	}))
+	defer tokenSrv.Close()
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc123" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="registry",scope="repository:e2e:pull"`, tokenSrv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `{"tags":["latest"]}`)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Auth = NewTokenAuthenticatorWithOptions(Credentials{Username: "user", Password: "secret"}, AuthenticatorOptions{
+		Retry: RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 2},
+	})
+	tags, err := reg.Repository("e2e").Tags().GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, tags)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		wait := p.backoff(attempt+1, nil)
+		assert.True(t, wait >= max/2 && wait <= max, "attempt %d waits %s", attempt+1, wait)
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", "3")
+	assert.Equal(t, 3*time.Second, p.backoff(1, resp))
+	resp.Header.Set("Retry-After", "3600")
+	assert.Equal(t, 5*time.Second, p.backoff(1, resp))
+}
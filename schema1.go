@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// v1Compatibility is the subset of the field "v1Compatibility" in the history of a manifest of schema v1 used by this library.
+type v1Compatibility struct {
+	Architecture    string `json:"architecture"`
+	Author          string `json:"author"`
+	Comment         string `json:"comment"`
+	ContainerConfig struct {
+		Cmd []string
+	} `json:"container_config"`
+	Created   time.Time `json:"created"`
+	OS        string    `json:"os"`
+	ThrowAway bool      `json:"throwaway"`
+	Variant   string    `json:"variant"`
+}
+
+// isSchema1 reports whether a manifest is of schema v1.
+// Registries send signed manifests of schema v1 as "application/vnd.docker.distribution.manifest.v1+prettyjws"
+// and unsigned manifests as "application/vnd.docker.distribution.manifest.v1+json" or "application/json".
+// The field "schemaVersion" identifies a manifest if the media type is ambiguous.
+func isSchema1(mediaType string, data []byte) bool {
+	switch mediaType {
+	case schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest:
+		return true
+	case "", "application/json":
+		var v manifest.Versioned
+		return json.Unmarshal(data, &v) == nil && v.SchemaVersion == 1
+	}
+
+	return false
+}
+
+// unmarshalSchema1 unmarshals a signed or an unsigned manifest of schema v1.
+// The Canonical field of an unsigned manifest is set to data.
+func unmarshalSchema1(data []byte) (*schema1.SignedManifest, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := &schema1.SignedManifest{}
+	if _, ok := fields["signatures"]; ok {
+		err = signed.UnmarshalJSON(data)
+		return signed, err
+	}
+
+	err = json.Unmarshal(data, &signed.Manifest)
+	signed.Canonical = data
+	return signed, err
+}
+
+// schema1Platform returns the platform of a manifest of schema v1.
+// The architecture is set in the manifest. The operating system is read from the newest entry in the history.
+func schema1Platform(m *schema1.SignedManifest) (Platform, error) {
+	p := Platform{
+		Architecture: m.Architecture,
+		Features:     []string{},
+		MediaType:    schema1.MediaTypeSignedManifest,
+		OS:           "linux",
+		OSFeatures:   []string{},
+	}
+	if len(m.History) == 0 {
+		return p, nil
+	}
+
+	var c v1Compatibility
+	err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &c)
+	if err != nil {
+		return p, errors.Wrap(err, "unmarshalling v1Compatibility")
+	}
+
+	if c.OS != "" {
+		p.OS = c.OS
+	}
+
+	p.Variant = c.Variant
+	return p, nil
+}
+
+// ConvertSchema1 converts a manifest of schema v1 into a manifest of schema v2.
+// It also returns the configuration of the image that it derives from the history of the manifest.
+// The digest of the configuration is set in the field Config of the returned manifest.
+//
+// The layers are ordered from the base layer to the top layer. Layers marked as "throwaway" are omitted.
+// Schema v1 does not store the sizes of layers or the digests of their uncompressed content,
+// so the sizes of the layers are 0 and "rootfs.diff_ids" of the configuration is empty.
+// The returned manifest is meant for reading. It cannot be pushed to a registry.
+func ConvertSchema1(m *schema1.SignedManifest) (schema2.Manifest, []byte, error) {
+	var out schema2.Manifest
+	if len(m.FSLayers) != len(m.History) {
+		return out, nil, fmt.Errorf("manifest schema v1 has %d layers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	if len(m.History) == 0 {
+		return out, nil, fmt.Errorf("manifest schema v1 has no history")
+	}
+
+	layers := []distribution.Descriptor{}
+	history := []History{}
+	// Schema v1 lists the top layer first.
+	for i := len(m.History) - 1; i >= 0; i-- {
+		var c v1Compatibility
+		err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &c)
+		if err != nil {
+			return out, nil, errors.Wrap(err, "unmarshalling v1Compatibility")
+		}
+
+		history = append(history, History{
+			Author:     c.Author,
+			Comment:    c.Comment,
+			Created:    c.Created,
+			CreatedBy:  strings.Join(c.ContainerConfig.Cmd, " "),
+			EmptyLayer: c.ThrowAway,
+		})
+		if c.ThrowAway {
+			continue
+		}
+
+		layers = append(layers, distribution.Descriptor{
+			Digest:    m.FSLayers[i].BlobSum,
+			MediaType: schema2.MediaTypeLayer,
+		})
+	}
+
+	// The newest entry in the history contains the configuration of the image.
+	config := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &config)
+	if err != nil {
+		return out, nil, errors.Wrap(err, "unmarshalling v1Compatibility")
+	}
+
+	for _, field := range []string{"id", "parent", "parent_id", "layer_id", "Size", "throwaway"} {
+		delete(config, field)
+	}
+
+	config["history"], err = json.Marshal(history)
+	if err != nil {
+		return out, nil, err
+	}
+
+	config["rootfs"] = json.RawMessage(`{"type":"layers","diff_ids":[]}`)
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return out, nil, err
+	}
+
+	out.Versioned = schema2.SchemaVersion
+	out.Config = distribution.Descriptor{
+		Digest:    digest.FromBytes(configJSON),
+		MediaType: schema2.MediaTypeImageConfig,
+		Size:      int64(len(configJSON)),
+	}
+	out.Layers = layers
+	return out, configJSON, nil
+}
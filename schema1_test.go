@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/libtrust"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSchema1Manifest(t *testing.T) *schema1.SignedManifest {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	require.NoError(t, err)
+
+	m := &schema1.Manifest{
+		Versioned:    manifest.Versioned{SchemaVersion: 1},
+		Name:         "e2e",
+		Tag:          "old",
+		Architecture: "arm",
+		FSLayers: []schema1.FSLayer{
+			{BlobSum: "sha256:3333333333333333333333333333333333333333333333333333333333333333"},
+			{BlobSum: "sha256:2222222222222222222222222222222222222222222222222222222222222222"},
+			{BlobSum: "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		},
+		History: []schema1.History{
+			{V1Compatibility: `{"id":"c","parent":"b","architecture":"arm","os":"linux","variant":"v7","config":{"Cmd":["sh"]},"container_config":{"Cmd":["/bin/sh","-c","#(nop) CMD [\"sh\"]"]},"created":"2019-01-03T00:00:00Z","throwaway":true}`},
+			{V1Compatibility: `{"id":"b","parent":"a","container_config":{"Cmd":["/bin/sh","-c","echo b > /b"]},"created":"2019-01-02T00:00:00Z"}`},
+			{V1Compatibility: `{"id":"a","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD file:abc in /"]},"created":"2019-01-01T00:00:00Z"}`},
+		},
+	}
+	signed, err := schema1.Sign(m, key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestConvertSchema1(t *testing.T) {
+	m, config, err := ConvertSchema1(newTestSchema1Manifest(t))
+	require.NoError(t, err)
+
+	assert.Equal(t, schema2.SchemaVersion, m.Versioned)
+	assert.Equal(t, schema2.MediaTypeImageConfig, m.Config.MediaType)
+	assert.Equal(t, digest.FromBytes(config), m.Config.Digest)
+	assert.Equal(t, int64(len(config)), m.Config.Size)
+	require.Len(t, m.Layers, 2)
+	assert.Equal(t, digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111"), m.Layers[0].Digest)
+	assert.Equal(t, digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222"), m.Layers[1].Digest)
+
+	var c struct {
+		Architecture string
+		Config       struct{ Cmd []string }
+		History      []struct {
+			CreatedBy  string `json:"created_by"`
+			EmptyLayer bool   `json:"empty_layer"`
+		}
+		ID     *string
+		Parent *string
+	}
+	require.NoError(t, json.Unmarshal(config, &c))
+	assert.Equal(t, "arm", c.Architecture)
+	assert.Equal(t, []string{"sh"}, c.Config.Cmd)
+	assert.Nil(t, c.ID)
+	assert.Nil(t, c.Parent)
+	require.Len(t, c.History, 3)
+	assert.Equal(t, "/bin/sh -c #(nop) ADD file:abc in /", c.History[0].CreatedBy)
+	assert.False(t, c.History[1].EmptyLayer)
+	assert.True(t, c.History[2].EmptyLayer)
+}
+
+func TestConvertSchema1_HistoryMismatch(t *testing.T) {
+	m := newTestSchema1Manifest(t)
+	m.FSLayers = m.FSLayers[1:]
+
+	_, _, err := ConvertSchema1(m)
+	assert.Error(t, err)
+}
+
+func schema1Handler(t *testing.T, signed *schema1.SignedManifest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, payload, err := signed.Payload()
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", schema1.MediaTypeSignedManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(signed.Canonical).String())
+		w.Write(payload)
+	})
+}
+
+// unsignedSchema1Handler serves the payload of signed without signatures with mediaType.
+func unsignedSchema1Handler(signed *schema1.SignedManifest, mediaType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(signed.Canonical).String())
+		w.Write(signed.Canonical)
+	})
+}
+
+func TestImageService_GetByTag_Schema1(t *testing.T) {
+	signed := newTestSchema1Manifest(t)
+	reg, closeFunc := newTestRegistry(t, schema1Handler(t, signed))
+	defer closeFunc()
+
+	img, err := reg.Repository("e2e").Images().GetByTag("old")
+	require.NoError(t, err)
+	require.Len(t, img.Platforms, 1)
+	assert.Equal(t, "arm", img.Platforms[0].Architecture)
+	assert.Equal(t, "linux", img.Platforms[0].OS)
+	assert.Equal(t, "v7", img.Platforms[0].Variant)
+	assert.Equal(t, schema1.MediaTypeSignedManifest, img.Platforms[0].MediaType)
+	assert.Equal(t, digest.FromBytes(signed.Canonical).String(), img.Platforms[0].Digest)
+}
+
+func TestManifestService_Get_Schema1(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, schema1Handler(t, newTestSchema1Manifest(t)))
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Manifests().Get("old")
+	assert.Equal(t, ErrSchemaV1NotSupported, err)
+
+	reg.convertSchema1 = true
+	m, err := reg.Repository("e2e").Manifests().Get("old")
+	require.NoError(t, err)
+	assert.Equal(t, schema2.MediaTypeManifest, m.MediaType)
+	assert.Len(t, m.Layers, 2)
+}
+
+func TestManifestService_Get_UnsignedSchema1(t *testing.T) {
+	testCases := []string{schema1.MediaTypeManifest, "application/json"}
+	for _, mediaType := range testCases {
+		t.Run(mediaType, func(t *testing.T) {
+			signed := newTestSchema1Manifest(t)
+			reg, closeFunc := newTestRegistry(t, unsignedSchema1Handler(signed, mediaType))
+			defer closeFunc()
+
+			_, err := reg.Repository("e2e").Manifests().Get("old")
+			assert.Equal(t, ErrSchemaV1NotSupported, err)
+
+			reg.convertSchema1 = true
+			m, err := reg.Repository("e2e").Manifests().Get("old")
+			require.NoError(t, err)
+			assert.Equal(t, schema2.MediaTypeManifest, m.MediaType)
+			assert.Len(t, m.Layers, 2)
+
+			img, err := reg.Repository("e2e").Images().GetByTag("old")
+			require.NoError(t, err)
+			require.Len(t, img.Platforms, 1)
+			assert.Equal(t, "arm", img.Platforms[0].Architecture)
+			assert.Equal(t, digest.FromBytes(signed.Canonical).String(), img.Platforms[0].Digest)
+		})
+	}
+}
@@ -2,8 +2,87 @@ package registry
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// paginatedTagsHandler serves the tags "a" to "e" in pages of size n, linking to the next page.
+func paginatedTagsHandler(t *testing.T) http.HandlerFunc {
+	all := []string{"a", "b", "c", "d", "e"}
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/e2e/tags/list", r.URL.Path)
+		n := 2
+		if r.URL.Query().Get("n") != "" {
+			n, _ = strconv.Atoi(r.URL.Query().Get("n"))
+		}
+
+		start := 0
+		for i, tag := range all {
+			if tag == r.URL.Query().Get("last") {
+				start = i + 1
+			}
+		}
+
+		end := start + n
+		if end < len(all) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/e2e/tags/list?last=%s&n=%d>; rel="next"`, all[end-1], n))
+		} else {
+			end = len(all)
+		}
+
+		fmt.Fprintf(w, `{"name":"e2e","tags":["%s"]}`, strings.Join(all[start:end], `","`))
+	}
+}
+
+func TestTagService_GetAll_Pagination(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, paginatedTagsHandler(t))
+	defer closeFunc()
+
+	tags, err := reg.Repository("e2e").Tags().GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, tags)
+}
+
+func TestTagService_GetPage(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, paginatedTagsHandler(t))
+	defer closeFunc()
+
+	page, err := reg.Repository("e2e").Tags().GetPage(ListOptions{PageSize: 3})
+	require.NoError(t, err)
+	assert.Equal(t, TagPage{Next: "c", Tags: []string{"a", "b", "c"}}, page)
+
+	page, err = reg.Repository("e2e").Tags().GetPage(ListOptions{Last: page.Next, PageSize: 3})
+	require.NoError(t, err)
+	assert.Equal(t, TagPage{Next: "", Tags: []string{"d", "e"}}, page)
+}
+
+func TestTagIterator_Resume(t *testing.T) {
+	reg, closeFunc := newTestRegistry(t, paginatedTagsHandler(t))
+	defer closeFunc()
+
+	it := reg.Repository("e2e").Tags().Iterator(ListOptions{})
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	require.True(t, it.Next())
+	assert.Equal(t, "c", it.Tag())
+
+	var tags []string
+	it = reg.Repository("e2e").Tags().Iterator(ListOptions{Last: it.Tag()})
+	for it.Next() {
+		tags = append(tags, it.Tag())
+	}
+
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"d", "e"}, tags)
+}
+
 var (
 	listTagsResult []string
 )
@@ -38,3 +117,23 @@ func theListOfTagsContains(tag string) error {
 
 	return fmt.Errorf("Tag '%s' not found", tag)
 }
+
+func TestTagIterator_LinkToOtherHost(t *testing.T) {
+	var requests int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"tags":["b"]}`)
+	}))
+	defer other.Close()
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/v2/e2e/tags/list?last=a>; rel="next"`, other.URL))
+		fmt.Fprint(w, `{"tags":["a"]}`)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Auth = NewBasicAuthenticator("user", "secret")
+	_, err := reg.Repository("e2e").Tags().GetAll()
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
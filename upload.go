@@ -0,0 +1,413 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Create starts a new upload of a blob.
+// Write the content of the blob to the returned BlobWriter and call Commit() to finish the upload.
+func (b *BlobService) Create() (*BlobWriter, error) {
+	return b.CreateContext(context.Background())
+}
+
+// CreateContext starts a new upload of a blob.
+// The context controls the lifetime of all requests sent by the returned BlobWriter.
+func (b *BlobService) CreateContext(ctx context.Context) (*BlobWriter, error) {
+	req, err := b.r.NewRequestContext(ctx, "POST", b.repo.httpPath("/blobs/uploads/"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.r.SendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkResponse(resp, http.StatusAccepted)
+	if err != nil {
+		return nil, errors.Wrap(err, "starting upload of blob")
+	}
+
+	resp.Body.Close()
+	w := &BlobWriter{ctx: ctx, digester: digest.Canonical.Digester(), r: b.r}
+	err = w.update(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Mount makes a blob of the repository from available in this repository without uploading its content.
+// Both repositories need to be in the same registry. from is the name of the repository, e.g. "staging/app".
+// mounted is true if the registry mounted the blob.
+// If the registry cannot mount the blob, e.g. because the blob does not exist in from, it starts a regular upload instead.
+// Mount then returns a BlobWriter to upload the content of the blob.
+func (b *BlobService) Mount(dgst, from string) (w *BlobWriter, mounted bool, err error) {
+	return b.MountContext(context.Background(), dgst, from)
+}
+
+// MountContext makes a blob of the repository from available in this repository without uploading its content.
+// The context controls the lifetime of the request and of all requests sent by the returned BlobWriter.
+func (b *BlobService) MountContext(ctx context.Context, dgst, from string) (w *BlobWriter, mounted bool, err error) {
+	q := url.Values{}
+	q.Set("from", from)
+	q.Set("mount", dgst)
+	req, err := b.r.NewRequestContext(ctx, "POST", b.repo.httpPath("/blobs/uploads/?"+q.Encode()), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := b.r.SendRequest(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = checkResponse(resp, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "mounting blob '%s' from '%s'", dgst, from)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return nil, true, nil
+	}
+
+	w = &BlobWriter{ctx: ctx, digester: digest.Canonical.Digester(), r: b.r}
+	err = w.update(resp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return w, false, nil
+}
+
+// Resume continues an upload that was started earlier, e.g. by another process.
+// Pass the value returned by BlobWriter.Location() of the interrupted upload.
+// The registry is queried for the number of bytes it received.
+func (b *BlobService) Resume(location string) (*BlobWriter, error) {
+	return b.ResumeContext(context.Background(), location)
+}
+
+// ResumeContext continues an upload that was started earlier.
+// The context controls the lifetime of all requests sent by the returned BlobWriter.
+func (b *BlobService) ResumeContext(ctx context.Context, location string) (*BlobWriter, error) {
+	req, err := b.r.newRequestURL(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.r.SendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkResponse(resp, http.StatusNoContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading status of upload")
+	}
+
+	resp.Body.Close()
+	// The content uploaded before is unknown, so Commit cannot verify the digest locally.
+	w := &BlobWriter{ctx: ctx, location: location, r: b.r}
+	err = w.update(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if h := resp.Header.Get("Range"); h != "" {
+		w.offset, err = parseUploadRange(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Upload uploads a blob in a single request.
+// size is the length of the content of r. Pass -1 if the length is unknown.
+// The registry verifies the content against dgst.
+func (b *BlobService) Upload(r io.Reader, size int64, dgst string) (Descriptor, error) {
+	return b.UploadContext(context.Background(), r, size, dgst)
+}
+
+// UploadContext uploads a blob in a single request.
+// The context controls the lifetime of the requests.
+func (b *BlobService) UploadContext(ctx context.Context, r io.Reader, size int64, dgst string) (Descriptor, error) {
+	w, err := b.CreateContext(ctx)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc, err := w.commit(r, size, dgst)
+	if err != nil {
+		w.Cancel()
+		return desc, err
+	}
+
+	return desc, nil
+}
+
+// BlobWriter uploads the content of a blob.
+// Each call to Write sends the content as a chunk in a PATCH request.
+// It is not safe for concurrent use.
+type BlobWriter struct {
+	ctx context.Context
+	// digester computes the digest of the uploaded content.
+	// It is nil if the upload was resumed or if a streamed chunk failed, because the content received by the registry is unknown then.
+	digester digest.Digester
+	location string
+	offset   int64
+	r        *Requester
+}
+
+// Location returns the URL of the upload. Pass it to BlobService.Resume() to continue an interrupted upload.
+func (w *BlobWriter) Location() string {
+	return w.location
+}
+
+// Offset returns the number of bytes that the registry received.
+func (w *BlobWriter) Offset() int64 {
+	return w.offset
+}
+
+// Write uploads p as the next chunk of the blob.
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := w.r.newRequestURL(w.ctx, "PATCH", w.location, bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", w.offset, w.offset+int64(len(p))-1))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	err = w.patch(req, func() int64 { return int64(len(p)) })
+	if err != nil {
+		return 0, err
+	}
+
+	if w.digester != nil {
+		w.digester.Hash().Write(p)
+	}
+
+	return len(p), nil
+}
+
+// ReadFrom uploads the content of r in a single streamed PATCH request.
+// It implements io.ReaderFrom so that io.Copy does not split the content into small chunks.
+func (w *BlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.digester != nil {
+		r = io.TeeReader(r, w.digester.Hash())
+	}
+
+	cr := &countingReader{r: r}
+	req, err := w.r.newRequestURL(w.ctx, "PATCH", w.location, cr)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	err = w.patch(req, func() int64 { return cr.n })
+	if err != nil {
+		// The registry might not have received all content that went through the digester.
+		w.digester = nil
+		return 0, err
+	}
+
+	return cr.n, nil
+}
+
+// Commit finishes the upload. The registry verifies the uploaded content against dgst.
+// It returns an error that wraps ErrDigestMismatch if the content written to the BlobWriter does not match dgst.
+func (w *BlobWriter) Commit(dgst string) (Descriptor, error) {
+	return w.commit(nil, 0, dgst)
+}
+
+// Cancel aborts the upload. The registry discards the content that it received.
+func (w *BlobWriter) Cancel() error {
+	req, err := w.r.newRequestURL(w.ctx, "DELETE", w.location, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.r.SendRequest(req)
+	if err != nil {
+		return err
+	}
+
+	err = checkResponse(resp, http.StatusNoContent)
+	if err != nil {
+		return errors.Wrap(err, "canceling upload of blob")
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// commit sends the final PUT request of the upload. body is the remaining content of the blob and can be nil.
+func (w *BlobWriter) commit(body io.Reader, size int64, dgst string) (Descriptor, error) {
+	var desc Descriptor
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return desc, errors.Wrapf(err, "parsing digest '%s'", dgst)
+	}
+
+	if body == nil && w.digester != nil && w.digester.Digest() != d {
+		return desc, errors.Wrapf(ErrDigestMismatch, "committing blob with digest '%s' as '%s'", w.digester.Digest(), dgst)
+	}
+
+	u, err := url.Parse(w.location)
+	if err != nil {
+		return desc, errors.Wrapf(err, "parsing location of upload '%s'", w.location)
+	}
+
+	q := u.Query()
+	q.Set("digest", dgst)
+	u.RawQuery = q.Encode()
+	var cr *countingReader
+	if body != nil {
+		cr = &countingReader{r: body}
+		body = cr
+	}
+
+	req, err := w.r.newRequestURL(w.ctx, "PUT", u.String(), body)
+	if err != nil {
+		return desc, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := w.r.SendRequest(req)
+	if err != nil {
+		return desc, err
+	}
+
+	err = checkResponse(resp, http.StatusCreated)
+	if err != nil {
+		return desc, errors.Wrapf(err, "committing blob '%s'", dgst)
+	}
+
+	resp.Body.Close()
+	if h := resp.Header.Get("Docker-Content-Digest"); h != "" && h != dgst {
+		return desc, errors.Wrapf(ErrDigestMismatch, "registry returned digest '%s' for blob '%s'", h, dgst)
+	}
+
+	desc.Digest = dgst
+	desc.MediaType = "application/octet-stream"
+	desc.Size = w.offset
+	if cr != nil {
+		desc.Size += cr.n
+	}
+
+	return desc, nil
+}
+
+// patch sends a chunk of the blob. sent returns the size of the chunk after the request has been sent.
+func (w *BlobWriter) patch(req *http.Request, sent func() int64) error {
+	resp, err := w.r.SendRequest(req)
+	if err != nil {
+		return err
+	}
+
+	err = checkResponse(resp, http.StatusAccepted)
+	if err != nil {
+		return errors.Wrap(err, "uploading chunk of blob")
+	}
+
+	resp.Body.Close()
+	err = w.update(resp)
+	if err != nil {
+		return err
+	}
+
+	return w.advance(resp, w.offset+sent())
+}
+
+// advance sets the offset of the upload to end, the number of bytes sent in total.
+// Registries report the number of bytes that they received in the Range header, which needs to match end.
+// If it does not, the offset is set to the number of bytes that the registry received.
+func (w *BlobWriter) advance(resp *http.Response, end int64) error {
+	if h := resp.Header.Get("Range"); h != "" {
+		received, err := parseUploadRange(h)
+		if err != nil {
+			return err
+		}
+
+		// "0-0" is also reported after the first byte, see parseUploadRange().
+		if received != end && !(received == 0 && end == 1) {
+			w.offset = received
+			// The content that went through the digester differs from the content that the registry received.
+			w.digester = nil
+			return fmt.Errorf("registry received %d bytes of the blob but %d bytes were sent", received, end)
+		}
+	}
+
+	w.offset = end
+	return nil
+}
+
+// update reads the location of the upload from a response. The registry can change the location with every response.
+func (w *BlobWriter) update(resp *http.Response) error {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		u, err := resp.Request.URL.Parse(loc)
+		if err != nil {
+			return errors.Wrapf(err, "parsing location of upload '%s'", loc)
+		}
+
+		w.location = u.String()
+	}
+
+	if w.location == "" {
+		return fmt.Errorf("registry did not return the location of the upload")
+	}
+
+	return nil
+}
+
+// parseUploadRange parses the Range header of an upload, e.g. "0-1023", and returns the number of bytes received.
+// Registries report "0-0" for uploads that did not receive any content yet, so "0-0" is treated as 0 bytes.
+func parseUploadRange(h string) (int64, error) {
+	parts := strings.SplitN(strings.TrimPrefix(h, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid range '%s'", h)
+	}
+
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing range '%s'", h)
+	}
+
+	if end <= 0 {
+		return 0, nil
+	}
+
+	return end + 1, nil
+}
+
+type countingReader struct {
+	n int64
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
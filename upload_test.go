@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadHandler emulates the upload of blobs of a registry.
+type uploadHandler struct {
+	canceled  bool
+	committed map[string][]byte
+	data      []byte
+	// drop is the number of bytes at the end of the next chunk that the handler discards.
+	drop int
+	t    *testing.T
+}
+
+func newUploadHandler(t *testing.T) *uploadHandler {
+	return &uploadHandler{committed: map[string][]byte{}, t: t}
+}
+
+func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v2/e2e/blobs/uploads/":
+		w.Header().Set("Location", "/v2/e2e/blobs/uploads/abc?_state=1")
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+	case r.URL.Path != "/v2/e2e/blobs/uploads/abc":
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "GET":
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(h.data)-1))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PATCH":
+		if cr := r.Header.Get("Content-Range"); cr != "" && !strings.HasPrefix(cr, fmt.Sprintf("%d-", len(h.data))) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(h.t, err)
+		h.data = append(h.data, body[:len(body)-h.drop]...)
+		h.drop = 0
+		w.Header().Set("Location", "/v2/e2e/blobs/uploads/abc?_state=2")
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(h.data)-1))
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(h.t, err)
+		h.data = append(h.data, body...)
+		dgst := r.URL.Query().Get("digest")
+		if digest.FromBytes(h.data).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`)
+			return
+		}
+
+		h.committed[dgst] = h.data
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE":
+		h.canceled = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBlobWriter_Chunked(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), w.Offset())
+	assert.Contains(t, w.Location(), "/v2/e2e/blobs/uploads/abc?_state=1")
+
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), w.Offset())
+	assert.Contains(t, w.Location(), "_state=2")
+
+	desc, err := w.Commit(digest.FromString("hello world").String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), desc.Size)
+	assert.Equal(t, []byte("hello world"), h.committed[digest.FromString("hello world").String()])
+}
+
+func TestBlobWriter_Write_ShortRange(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	h.drop = 3
+	_, err = w.Write([]byte("world"))
+	assert.Error(t, err)
+	assert.Equal(t, int64(8), w.Offset())
+
+	// The upload continues at the offset that the registry acknowledged.
+	_, err = w.Write([]byte("rld"))
+	require.NoError(t, err)
+	desc, err := w.Commit(digest.FromString("hello world").String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), desc.Size)
+}
+
+func TestBlobWriter_ReadFrom(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	n, err := io.Copy(w, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+
+	_, err = w.Commit(digest.FromString("hello world").String())
+	require.NoError(t, err)
+}
+
+func TestBlobWriter_Commit_DigestMismatch(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = w.Commit(digest.FromString("world").String())
+	assert.Equal(t, ErrDigestMismatch, errors.Cause(err))
+	assert.Empty(t, h.committed)
+
+	require.NoError(t, w.Cancel())
+	assert.True(t, h.canceled)
+}
+
+func TestBlobService_Resume(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	resumed, err := reg.Repository("e2e").Blobs().Resume(w.Location())
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), resumed.Offset())
+	_, err = resumed.Write([]byte("world"))
+	require.NoError(t, err)
+
+	desc, err := resumed.Commit(digest.FromString("hello world").String())
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), desc.Size)
+}
+
+func TestBlobService_Upload(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	content := []byte("hello world")
+	desc, err := reg.Repository("e2e").Blobs().Upload(bytes.NewReader(content), int64(len(content)), digest.FromBytes(content).String())
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(content).String(), desc.Digest)
+	assert.Equal(t, int64(len(content)), desc.Size)
+	assert.Equal(t, content, h.committed[desc.Digest])
+}
+
+func TestBlobService_Upload_Invalid(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTestRegistry(t, h)
+	defer closeFunc()
+
+	_, err := reg.Repository("e2e").Blobs().Upload(strings.NewReader("hello"), 5, digest.FromString("world").String())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrorCodeDigestInvalid))
+	assert.True(t, h.canceled)
+}
+
+func TestBlobService_Upload_TokenAuth(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTokenTestRegistry(t, h)
+	defer closeFunc()
+
+	desc, err := reg.Repository("e2e").Blobs().Upload(strings.NewReader("hello"), 5, digest.FromString("hello").String())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), h.committed[desc.Digest])
+}
+
+func TestBlobWriter_ReadFrom_TokenAuth(t *testing.T) {
+	h := newUploadHandler(t)
+	reg, closeFunc := newTokenTestRegistry(t, h)
+	defer closeFunc()
+
+	w, err := reg.Repository("e2e").Blobs().Create()
+	require.NoError(t, err)
+	n, err := io.Copy(w, io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	_, err = w.Commit(digest.FromString("hello world").String())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), h.committed[digest.FromString("hello world").String()])
+}
+
+func TestRequester_SendRequest_BodyNotRewindable(t *testing.T) {
+	reg, closeFunc := newTokenTestRegistry(t, http.NotFoundHandler())
+	defer closeFunc()
+
+	req, err := reg.Requester.NewRequest("PATCH", "/e2e/blobs/uploads/abc", io.MultiReader(strings.NewReader("hello")))
+	require.NoError(t, err)
+	_, err = reg.Requester.SendRequest(req)
+	assert.Error(t, err)
+}
+
+func TestBlobService_Mount(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"repository:prod/app:pull,push", "repository:staging/app:pull"}, r.URL.Query()["scope"])
+		fmt.Fprint(w, `{"token":"abc123","expires_in":300}`)
+	}))
+	defer tokenSrv.Close()
+
+	reg, closeFunc := newTestRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc123" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="registry",scope="repository:prod/app:pull,push"`, tokenSrv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v2/prod/app/blobs/uploads/", r.URL.Path)
+		assert.Equal(t, "staging/app", r.URL.Query().Get("from"))
+		if r.URL.Query().Get("mount") == "sha256:1111111111111111111111111111111111111111111111111111111111111111" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		w.Header().Set("Location", "/v2/prod/app/blobs/uploads/abc")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer closeFunc()
+
+	reg.Requester.Auth = NewTokenAuthenticator()
+	_, mounted, err := reg.Repository("prod/app").Blobs().Mount("sha256:1111111111111111111111111111111111111111111111111111111111111111", "staging/app")
+	require.NoError(t, err)
+	assert.True(t, mounted)
+
+	w, mounted, err := reg.Repository("prod/app").Blobs().Mount("sha256:2222222222222222222222222222222222222222222222222222222222222222", "staging/app")
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	require.NotNil(t, w)
+	assert.Contains(t, w.Location(), "/v2/prod/app/blobs/uploads/abc")
+}
+
+func TestParseUploadRange(t *testing.T) {
+	for h, expected := range map[string]int64{"0-0": 0, "0-1023": 1024, "bytes=0-9": 10} {
+		offset, err := parseUploadRange(h)
+		require.NoError(t, err)
+		assert.Equal(t, expected, offset, h)
+	}
+
+	_, err := parseUploadRange("invalid")
+	assert.Error(t, err)
+}